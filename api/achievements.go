@@ -0,0 +1,297 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Achievement ids are chosen by game developers and sent back by games in every sync
+var achievementIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]{0,63}$`)
+
+const (
+	LedgerReasonAchievementReward = "achievement_reward"
+	AnomalyUnknownAchievement     = "unknown_achievement"
+)
+
+/**
+ * ManifestAchievement declares an achievement a game can unlock, in manifest.json
+ * Rewards are granted by the server when the achievement is first unlocked in the game
+ */
+type ManifestAchievement struct {
+	Id          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Icon        string `json:"icon,omitempty"`
+	Hidden      bool   `json:"hidden,omitempty"`
+	Points      int    `json:"points,omitempty"`
+	XpReward    int    `json:"xpReward,omitempty"`
+	CoinReward  int    `json:"coinReward,omitempty"`
+}
+
+/**
+ * Achievement is a catalog entry as listed to players
+ * Rarity is the percentage of the game's players who have unlocked it
+ */
+type Achievement struct {
+	GameSlug string `json:"gameSlug"`
+	ManifestAchievement
+	IconUrl  string  `json:"iconUrl,omitempty"`
+	Rarity   float64 `json:"rarity"`
+	Unlocked bool    `json:"unlocked"`
+}
+
+/**
+ * checkManifestAchievements validates the achievements declared in a manifest.json
+ * @param {[]ManifestAchievement} achievements - Declared achievements
+ * @param {map[string]bool} assets - Asset paths listed in the manifest
+ * @returns {[]string} Problems found
+ */
+func checkManifestAchievements(achievements []ManifestAchievement, assets map[string]bool) []string {
+	problems := []string{}
+	seen := map[string]bool{}
+	for _, achievement := range achievements {
+		switch {
+		case !achievementIdPattern.MatchString(achievement.Id):
+			problems = append(problems, fmt.Sprintf("achievement id %q must be 1-64 letters, digits, '_', '.', ':' or '-'", achievement.Id))
+		case seen[achievement.Id]:
+			problems = append(problems, fmt.Sprintf("achievement %q is listed more than once", achievement.Id))
+		}
+		seen[achievement.Id] = true
+
+		if achievement.Title == "" {
+			problems = append(problems, fmt.Sprintf("achievement %q needs a title", achievement.Id))
+		}
+		if achievement.Points < 0 || achievement.XpReward < 0 || achievement.CoinReward < 0 {
+			problems = append(problems, fmt.Sprintf("achievement %q cannot have negative points or rewards", achievement.Id))
+		}
+		if achievement.Icon != "" && !assets[achievement.Icon] {
+			problems = append(problems, fmt.Sprintf("achievement %q icon %q must also be listed in assets", achievement.Id, achievement.Icon))
+		}
+	}
+	return problems
+}
+
+/**
+ * syncAchievementCatalog makes the achievements table match a game's live release
+ * Achievements dropped from the manifest are retired rather than deleted, so players keep them
+ * Releases registered before manifests were stored leave the catalog unchanged
+ * @param {*sql.Tx} tx - Transaction
+ * @param {string} gameId - Game ID
+ * @param {string} releaseId - Live release ID
+ * @returns {error} Error if any
+ */
+func syncAchievementCatalog(tx *sql.Tx, gameId string, releaseId string) error {
+	var slug, storedManifest string
+	err := tx.QueryRow(`
+		SELECT g.slug, COALESCE(r.manifestJson, '') FROM games g JOIN game_releases r ON r.gameId = g.id
+		WHERE g.id = ? AND r.id = ?
+	`, gameId, releaseId).Scan(&slug, &storedManifest)
+	if err != nil || storedManifest == "" {
+		return err
+	}
+
+	var manifest GameManifestV2
+	if err := json.Unmarshal([]byte(storedManifest), &manifest); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE achievements SET retiredAt = CURRENT_TIMESTAMP WHERE gameSlug = ? AND retiredAt IS NULL", slug)
+	if err != nil {
+		return err
+	}
+	for _, achievement := range manifest.Achievements {
+		_, err := tx.Exec(`
+			INSERT INTO achievements(gameSlug, id, title, description, icon, hidden, points, xpReward, coinReward, updatedAt)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(gameSlug, id) DO UPDATE SET
+				title = excluded.title,
+				description = excluded.description,
+				icon = excluded.icon,
+				hidden = excluded.hidden,
+				points = excluded.points,
+				xpReward = excluded.xpReward,
+				coinReward = excluded.coinReward,
+				retiredAt = NULL,
+				updatedAt = excluded.updatedAt
+		`, slug, achievement.Id, achievement.Title, achievement.Description, achievement.Icon, achievement.Hidden,
+			achievement.Points, achievement.XpReward, achievement.CoinReward)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * resolveAchievementUnlocks checks a sync's achievements against the game's catalog
+ * @param {queryer} db - The sync's transaction
+ * @param {string} gameSlug - Game the sync came from; syncs without one cannot unlock achievements
+ * @param {[]string} requested - Achievement ids the client reported
+ * @param {[]string} held - Achievements the user already has in this game
+ * @returns {[]ManifestAchievement} Known achievements that are new to the user, in request order
+ * @returns {[]string} Ids that are not in the catalog (or are retired)
+ * @returns {error} Error if any
+ */
+func resolveAchievementUnlocks(db queryer, gameSlug string, requested []string, held []string) ([]ManifestAchievement, []string, error) {
+	unlocked := []ManifestAchievement{}
+	unknown := []string{}
+	for _, id := range newStrings(held, requested) {
+		var achievement ManifestAchievement
+		err := db.QueryRow(`
+			SELECT id, title, description, icon, hidden, points, xpReward, coinReward FROM achievements
+			WHERE gameSlug = ? AND id = ? AND retiredAt IS NULL
+		`, gameSlug, id).Scan(&achievement.Id, &achievement.Title, &achievement.Description, &achievement.Icon,
+			&achievement.Hidden, &achievement.Points, &achievement.XpReward, &achievement.CoinReward)
+		if err == sql.ErrNoRows {
+			unknown = append(unknown, id)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		unlocked = append(unlocked, achievement)
+	}
+	return unlocked, unknown, nil
+}
+
+/**
+ * achievementRewardEntries lists the ledger entries for the rewards of newly unlocked achievements
+ * @returns {[]LedgerEntry} Entries to append
+ * @returns {int} Total coins awarded
+ * @returns {int} Total XP awarded
+ */
+func achievementRewardEntries(userId string, syncReq ProgressionSyncRequest, unlocked []ManifestAchievement) ([]LedgerEntry, int, int) {
+	entries := []LedgerEntry{}
+	var coins, xp int
+	for _, achievement := range unlocked {
+		reward := LedgerEntry{
+			UserId:          userId,
+			GameSlug:        syncReq.GameSlug,
+			DeviceId:        syncReq.DeviceId,
+			BatchId:         syncReq.BatchId,
+			ItemId:          achievement.Id,
+			Reason:          LedgerReasonAchievementReward,
+			ClientTimestamp: syncReq.ClientLastSyncedAt,
+		}
+		if achievement.CoinReward > 0 {
+			reward.Kind, reward.Delta = LedgerCoins, achievement.CoinReward
+			entries = append(entries, reward)
+			coins += achievement.CoinReward
+		}
+		if achievement.XpReward > 0 {
+			reward.Kind, reward.Delta = LedgerXp, achievement.XpReward
+			entries = append(entries, reward)
+			xp += achievement.XpReward
+		}
+	}
+	return entries, coins, xp
+}
+
+/**
+ * GetGameAchievements lists a game's achievements with how rare each one is
+ * Hidden achievements the current user has not unlocked are listed without their details
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetGameAchievements(c *fiber.Ctx, db *sql.DB) error {
+	slug := c.Params("slug")
+
+	var manifestPath string
+	err := db.QueryRow("SELECT manifestPath FROM games WHERE slug = ? AND retiredAt IS NULL", slug).Scan(&manifestPath)
+	if err == sql.ErrNoRows {
+		return ErrorResponse(c, 404, "Game not found")
+	}
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	_, baseUrl, _ := ResolveManifestPath(manifestPath)
+
+	held := map[string]bool{}
+	if userId := GetOptionalUserId(c); userId != "" {
+		progression, err := loadGameProgression(db, userId, slug)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		for _, id := range progression.Achievements {
+			held[id] = true
+		}
+	}
+
+	holders, players, err := achievementHolders(db, slug)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT id, title, description, icon, hidden, points, xpReward, coinReward FROM achievements
+		WHERE gameSlug = ? AND retiredAt IS NULL
+		ORDER BY rowid
+	`, slug)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer rows.Close()
+
+	achievements := []Achievement{}
+	for rows.Next() {
+		achievement := Achievement{GameSlug: slug}
+		err := rows.Scan(&achievement.Id, &achievement.Title, &achievement.Description, &achievement.Icon,
+			&achievement.Hidden, &achievement.Points, &achievement.XpReward, &achievement.CoinReward)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		achievement.Unlocked = held[achievement.Id]
+		if players > 0 {
+			achievement.Rarity = math.Round(float64(holders[achievement.Id])*1000/float64(players)) / 10
+		}
+		if achievement.Hidden && !achievement.Unlocked {
+			achievement.Title, achievement.Description, achievement.Icon = "Hidden achievement", "", ""
+		}
+		if achievement.Icon != "" && baseUrl != "" {
+			achievement.IconUrl = baseUrl + achievement.Icon
+		}
+		achievements = append(achievements, achievement)
+	}
+
+	return c.JSON(fiber.Map{"achievements": achievements, "players": players})
+}
+
+/**
+ * achievementHolders counts how many of a game's players hold each achievement
+ * @returns {map[string]int} Holders per achievement id
+ * @returns {int} Players with any progression in the game
+ * @returns {error} Error if any
+ */
+func achievementHolders(db *sql.DB, slug string) (map[string]int, int, error) {
+	holders := map[string]int{}
+	var players int
+	if err := db.QueryRow("SELECT COUNT(*) FROM game_progression WHERE gameSlug = ?", slug).Scan(&players); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT unlocked.value, COUNT(*) FROM game_progression, json_each(game_progression.achievements) AS unlocked
+		WHERE game_progression.gameSlug = ?
+		GROUP BY unlocked.value
+	`, slug)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, 0, err
+		}
+		holders[id] = count
+	}
+	return holders, players, rows.Err()
+}
@@ -0,0 +1,409 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"strings"
+	"time"
+)
+
+/**
+ * CatalogQuery holds the search, filter, sort and pagination options for the game catalog
+ */
+type CatalogQuery struct {
+	Search        string
+	Tier          string
+	Category      string
+	Tag           string
+	Rating        string
+	MinSize       int64
+	MaxSize       int64
+	Sort          string
+	Cursor        string
+	Limit         int
+	IncludeLocked bool
+	Collection    string
+	Favorites     bool
+}
+
+/**
+ * catalogCursor is the keyset position after the last game of a page
+ */
+type catalogCursor struct {
+	SortKey interface{} `json:"k"`
+	Id      string      `json:"id"`
+}
+
+const (
+	defaultCatalogLimit = 50
+	maxCatalogLimit     = 100
+	popularityWindow    = 30 * 24 * time.Hour
+)
+
+/**
+ * catalogSorts maps each sort option to its sort key expression and direction
+ */
+var catalogSorts = map[string]struct {
+	expression string
+	descending bool
+}{
+	"name":       {"LOWER(g.name)", false},
+	"newest":     {"CAST(g.createdAt AS TEXT)", true},
+	"size":       {"g.sizeBytes", false},
+	"popularity": {"(SELECT COUNT(DISTINCT ps.userId) FROM play_sessions ps WHERE ps.gameSlug = g.slug AND ps.startedAt >= ?)", true},
+	"relevance":  {"bm25(games_fts)", false},
+	"position":   {"cg.position", false},
+}
+
+/**
+ * ParseCatalogQuery reads catalog options from the query string
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {string} collection - Collection slug to restrict results to (empty for the whole catalog)
+ * @returns {CatalogQuery, error} - Parsed options and a validation error if any
+ */
+func ParseCatalogQuery(c *fiber.Ctx, collection string) (CatalogQuery, error) {
+	query := CatalogQuery{
+		Search:        strings.TrimSpace(c.Query("q")),
+		Tier:          c.Query("tier"),
+		Category:      c.Query("category"),
+		Tag:           strings.ToLower(c.Query("tag")),
+		Rating:        c.Query("rating"),
+		MinSize:       int64(c.QueryInt("minSize", 0)),
+		MaxSize:       int64(c.QueryInt("maxSize", 0)),
+		Sort:          c.Query("sort"),
+		Cursor:        c.Query("cursor"),
+		Limit:         c.QueryInt("limit", defaultCatalogLimit),
+		IncludeLocked: c.QueryBool("includeLocked", false),
+		Collection:    collection,
+		Favorites:     c.QueryBool("favorites", false),
+	}
+
+	if query.Sort == "" {
+		query.Sort = "name"
+		if query.Search != "" {
+			// Without FTS5 there is no relevance score, so searches stay in alphabetical order
+			if FullTextSearchEnabled {
+				query.Sort = "relevance"
+			}
+		} else if query.Collection != "" {
+			query.Sort = "position"
+		}
+	}
+	if _, ok := catalogSorts[query.Sort]; !ok {
+		return query, fmt.Errorf("sort must be one of name, newest, popularity, size, relevance or position")
+	}
+	if query.Sort == "relevance" && query.Search == "" {
+		return query, fmt.Errorf("sort=relevance requires q")
+	}
+	if query.Sort == "position" && query.Collection == "" {
+		return query, fmt.Errorf("sort=position requires a collection")
+	}
+	if query.Sort == "relevance" && !FullTextSearchEnabled {
+		return query, fmt.Errorf("sort=relevance requires a server built with full-text search")
+	}
+	if query.Tier != "" && !containsString(subscriptionTiers, query.Tier) {
+		return query, fmt.Errorf("invalid tier")
+	}
+	if query.Rating != "" {
+		if _, ok := ratingHierarchy[query.Rating]; !ok {
+			return query, fmt.Errorf("invalid rating")
+		}
+	}
+	if query.MinSize < 0 || query.MaxSize < 0 {
+		return query, fmt.Errorf("minSize and maxSize must not be negative")
+	}
+	if query.Limit < 1 || query.Limit > maxCatalogLimit {
+		return query, fmt.Errorf("limit must be between 1 and %d", maxCatalogLimit)
+	}
+
+	return query, nil
+}
+
+/**
+ * ftsMatchExpression turns free text into an FTS5 query of quoted prefix terms
+ * Quoting keeps user input from being parsed as FTS5 syntax
+ */
+func ftsMatchExpression(search string) string {
+	terms := []string{}
+	for _, word := range strings.Fields(search) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+func escapeLike(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(value)
+}
+
+func placeholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", count), ", ")
+}
+
+/**
+ * gameAccessExpression builds an SQL expression over games g that is true for the games
+ * a user can access through their subscription tier or an active entitlement
+ * @param {string} userId - User ID (empty for anonymous requests)
+ * @param {string} userTier - User's subscription tier
+ * @returns {string, []interface{}} - Expression and its arguments
+ */
+func gameAccessExpression(userId string, userTier string) (string, []interface{}) {
+	args := []interface{}{}
+	expression := "0"
+	accessibleTiers := []string{}
+	for _, tier := range subscriptionTiers {
+		if CanAccessTier(userTier, tier) {
+			accessibleTiers = append(accessibleTiers, tier)
+		}
+	}
+	if len(accessibleTiers) > 0 {
+		expression = "g.tierRequired IN (" + placeholders(len(accessibleTiers)) + ")"
+		for _, tier := range accessibleTiers {
+			args = append(args, tier)
+		}
+	}
+	if userId != "" {
+		expression += ` OR EXISTS (
+			SELECT 1 FROM game_entitlements e
+			WHERE e.userId = ? AND e.gameId = g.id AND e.revokedAt IS NULL
+			AND (e.expiresAt IS NULL OR e.expiresAt > CURRENT_TIMESTAMP))`
+		args = append(args, userId)
+	}
+	return expression, args
+}
+
+/**
+ * parentalConditions builds the SQL conditions over games g that parental controls add to the catalog
+ * Blocked games are never shown; allowed games bypass the rating limit
+ * @param {*ParentalControls} controls - Parental controls for the user, or nil
+ * @returns {[]string, []interface{}} - Conditions and their arguments
+ */
+func parentalConditions(controls *ParentalControls) ([]string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	if controls == nil {
+		return conditions, args
+	}
+
+	if len(controls.BlockedGames) > 0 {
+		conditions = append(conditions, "g.slug NOT IN ("+placeholders(len(controls.BlockedGames))+")")
+		for _, slug := range controls.BlockedGames {
+			args = append(args, slug)
+		}
+	}
+	allowedRatings := []string{}
+	for rating := range ratingHierarchy {
+		if CanAccessRating(controls.MaxRating, rating) {
+			allowedRatings = append(allowedRatings, rating)
+		}
+	}
+	ratingCondition := "0"
+	if len(allowedRatings) > 0 {
+		ratingCondition = "g.rating IN (" + placeholders(len(allowedRatings)) + ")"
+		for _, rating := range allowedRatings {
+			args = append(args, rating)
+		}
+	}
+	if len(controls.AllowedGames) > 0 {
+		ratingCondition += " OR g.slug IN (" + placeholders(len(controls.AllowedGames)) + ")"
+		for _, slug := range controls.AllowedGames {
+			args = append(args, slug)
+		}
+	}
+	return append(conditions, "("+ratingCondition+")"), args
+}
+
+/**
+ * catalogVisibility builds the condition over games g for what a user's default catalog listing shows:
+ * games they can access that parental controls do not hide
+ * @param {string} userId - User ID (empty for anonymous requests)
+ * @param {string} userTier - User's subscription tier
+ * @param {*ParentalControls} controls - Parental controls for the user, or nil
+ * @returns {string, []interface{}} - Condition and its arguments
+ */
+func catalogVisibility(userId string, userTier string, controls *ParentalControls) (string, []interface{}) {
+	access, args := gameAccessExpression(userId, userTier)
+	conditions := []string{"(" + access + ")"}
+	parental, parentalArgs := parentalConditions(controls)
+	return strings.Join(append(conditions, parental...), " AND "), append(args, parentalArgs...)
+}
+
+/**
+ * QueryCatalog runs a catalog query with tier, entitlement and parental filtering done in SQL
+ * @param {*sql.DB} db - Database connection
+ * @param {string} userId - User ID (empty for anonymous requests)
+ * @param {string} userTier - User's subscription tier
+ * @param {*ParentalControls} controls - Parental controls for the user, or nil
+ * @param {CatalogQuery} query - Catalog options
+ * @returns {[]Game, string, error} - Page of games, cursor for the next page (empty on the last page) and error if any
+ */
+func QueryCatalog(db *sql.DB, userId string, userTier string, controls *ParentalControls, query CatalogQuery) ([]Game, string, error) {
+	sort := catalogSorts[query.Sort]
+	var args []interface{}
+
+	accessExpression, selectArgs := gameAccessExpression(userId, userTier)
+	if query.Sort == "popularity" {
+		selectArgs = append(selectArgs, time.Now().UTC().Add(-popularityWindow))
+	}
+	args = append(args, selectArgs...)
+
+	from := "games g"
+	conditions := []string{"g.retiredAt IS NULL"}
+
+	if query.Search != "" {
+		if FullTextSearchEnabled {
+			from = "games g JOIN games_fts ON games_fts.rowid = g.rowid"
+			conditions = append(conditions, "games_fts MATCH ?")
+			args = append(args, ftsMatchExpression(query.Search))
+		} else {
+			pattern := "%" + escapeLike(query.Search) + "%"
+			conditions = append(conditions, `(g.name LIKE ? ESCAPE '\' OR g.description LIKE ? ESCAPE '\')`)
+			args = append(args, pattern, pattern)
+		}
+	}
+	if query.Tier != "" {
+		conditions = append(conditions, "g.tierRequired = ?")
+		args = append(args, query.Tier)
+	}
+	if query.Rating != "" {
+		conditions = append(conditions, "g.rating = ?")
+		args = append(args, query.Rating)
+	}
+	if query.Category != "" {
+		conditions = append(conditions, `EXISTS (
+			SELECT 1 FROM game_categories gc JOIN categories cat ON cat.id = gc.categoryId
+			WHERE gc.gameId = g.id AND cat.slug = ?)`)
+		args = append(args, query.Category)
+	}
+	if query.Tag != "" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM game_tags gt WHERE gt.gameId = g.id AND gt.tag = ?)")
+		args = append(args, query.Tag)
+	}
+	if query.Collection != "" {
+		from += " JOIN collection_games cg ON cg.gameId = g.id JOIN collections col ON col.id = cg.collectionId"
+		conditions = append(conditions, "col.slug = ?")
+		args = append(args, query.Collection)
+	}
+	if query.Favorites {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM user_favorites uf WHERE uf.userId = ? AND uf.gameId = g.id)")
+		args = append(args, userId)
+	}
+	if query.MinSize > 0 {
+		conditions = append(conditions, "g.sizeBytes >= ?")
+		args = append(args, query.MinSize)
+	}
+	if query.MaxSize > 0 {
+		conditions = append(conditions, "g.sizeBytes <= ?")
+		args = append(args, query.MaxSize)
+	}
+
+	parental, parentalArgs := parentalConditions(controls)
+	conditions = append(conditions, parental...)
+	args = append(args, parentalArgs...)
+
+	where := "WHERE " + strings.Join(conditions, " AND ")
+
+	outerConditions := []string{}
+	if !query.IncludeLocked {
+		outerConditions = append(outerConditions, "hasAccess = 1")
+	}
+
+	comparison, direction := ">", "ASC"
+	if sort.descending {
+		comparison, direction = "<", "DESC"
+	}
+	if query.Cursor != "" {
+		cursor, err := decodeCatalogCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		outerConditions = append(outerConditions, fmt.Sprintf("(sortKey %s ? OR (sortKey = ? AND id %s ?))", comparison, comparison))
+		args = append(args, cursor.SortKey, cursor.SortKey, cursor.Id)
+	}
+
+	outerWhere := ""
+	if len(outerConditions) > 0 {
+		outerWhere = "WHERE " + strings.Join(outerConditions, " AND ")
+	}
+
+	// Fetch one extra row to learn whether there is another page
+	args = append(args, query.Limit+1)
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT id, slug, name, description, version, tierRequired, manifestPath, sizeBytes, rating, createdAt, updatedAt, categories, tags, hasAccess, sortKey
+		FROM (
+			SELECT g.id, g.slug, g.name, COALESCE(g.description, '') AS description, g.version, g.tierRequired, g.manifestPath,
+				g.sizeBytes, g.rating, g.createdAt, g.updatedAt,
+				(SELECT COALESCE(GROUP_CONCAT(cat.slug), '') FROM game_categories gc JOIN categories cat ON cat.id = gc.categoryId WHERE gc.gameId = g.id) AS categories,
+				(SELECT COALESCE(GROUP_CONCAT(gt.tag), '') FROM game_tags gt WHERE gt.gameId = g.id) AS tags,
+				CASE WHEN %s THEN 1 ELSE 0 END AS hasAccess,
+				%s AS sortKey
+			FROM %s
+			%s
+		)
+		%s
+		ORDER BY sortKey %s, id %s
+		LIMIT ?
+	`, accessExpression, sort.expression, from, where, outerWhere, direction, direction), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	games := []Game{}
+	var lastSortKey interface{}
+	for rows.Next() {
+		var game Game
+		var hasAccess bool
+		var sortKey interface{}
+		var categories, tags string
+		err := rows.Scan(&game.Id, &game.Slug, &game.Name, &game.Description, &game.Version, &game.TierRequired, &game.ManifestPath, &game.SizeBytes, &game.Rating, &game.CreatedAt, &game.UpdatedAt, &categories, &tags, &hasAccess, &sortKey)
+		if err != nil {
+			return nil, "", err
+		}
+		game.Categories = splitList(categories)
+		game.Tags = splitList(tags)
+		if len(games) == query.Limit {
+			return games, encodeCatalogCursor(lastSortKey, games[len(games)-1].Id), nil
+		}
+		game.Access = buildGameAccess(userId, hasAccess, game)
+		games = append(games, game)
+		lastSortKey = sortKey
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	return games, "", nil
+}
+
+func encodeCatalogCursor(sortKey interface{}, id string) string {
+	if bytes, ok := sortKey.([]byte); ok {
+		sortKey = string(bytes)
+	}
+	data, _ := json.Marshal(catalogCursor{SortKey: sortKey, Id: id})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCatalogCursor(value string) (catalogCursor, error) {
+	var cursor catalogCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, fiber.NewError(fiber.StatusBadRequest, "Invalid cursor")
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Id == "" {
+		return cursor, fiber.NewError(fiber.StatusBadRequest, "Invalid cursor")
+	}
+	return cursor, nil
+}
+
+// splitList splits a GROUP_CONCAT result; slugs and tags never contain commas
+func splitList(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
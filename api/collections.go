@@ -0,0 +1,528 @@
+package api
+
+import (
+	"database/sql"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"regexp"
+	"strings"
+)
+
+type Category struct {
+	Id        string `json:"id"`
+	Slug      string `json:"slug"`
+	Name      string `json:"name"`
+	SortOrder int    `json:"sortOrder"`
+	GameCount int    `json:"gameCount"`
+}
+
+type Collection struct {
+	Id          string `json:"id"`
+	Slug        string `json:"slug"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	SortOrder   int    `json:"sortOrder"`
+	GameCount   int    `json:"gameCount"`
+	CreatedAt   string `json:"createdAt,omitempty"`
+	UpdatedAt   string `json:"updatedAt,omitempty"`
+}
+
+/**
+ * CollectionRequest is the admin payload for creating or replacing a collection
+ * Games are listed in display order
+ */
+type CollectionRequest struct {
+	Slug        string   `json:"slug"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	SortOrder   int      `json:"sortOrder"`
+	Games       []string `json:"games"`
+}
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+/**
+ * ValidateSlug checks that a slug is lowercase letters, digits and single hyphens
+ * @param {string} slug - Slug to validate
+ * @returns {bool} True if the slug is valid
+ */
+func ValidateSlug(slug string) bool {
+	return len(slug) <= 64 && slugPattern.MatchString(slug)
+}
+
+/**
+ * requestCatalogVisibility builds catalogVisibility for the user making the request, if any,
+ * so listing counts match what their catalog shows
+ */
+func requestCatalogVisibility(c *fiber.Ctx, db *sql.DB) (string, []interface{}, error) {
+	userId := GetOptionalUserId(c)
+	controls, err := GetParentalControls(db, userId)
+	if err != nil {
+		return "", nil, err
+	}
+	visible, args := catalogVisibility(userId, GetUserTier(db, userId), controls)
+	return visible, args, nil
+}
+
+/**
+ * GetCategories lists categories with the number of games in each the user's catalog shows
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetCategories(c *fiber.Ctx, db *sql.DB) error {
+	visible, visibleArgs, err := requestCatalogVisibility(c, db)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT cat.id, cat.slug, cat.name, cat.sortOrder, COUNT(g.id)
+		FROM categories cat
+		LEFT JOIN game_categories gc ON gc.categoryId = cat.id
+		LEFT JOIN games g ON g.id = gc.gameId AND g.retiredAt IS NULL AND `+visible+`
+		GROUP BY cat.id
+		ORDER BY cat.sortOrder ASC, cat.name ASC
+	`, visibleArgs...)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer rows.Close()
+
+	categories := []Category{}
+	for rows.Next() {
+		var category Category
+		if err := rows.Scan(&category.Id, &category.Slug, &category.Name, &category.SortOrder, &category.GameCount); err != nil {
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		categories = append(categories, category)
+	}
+
+	return c.JSON(fiber.Map{"categories": categories})
+}
+
+/**
+ * GetCollections lists collections in display order, counting the games the user's catalog shows
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetCollections(c *fiber.Ctx, db *sql.DB) error {
+	visible, visibleArgs, err := requestCatalogVisibility(c, db)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT col.id, col.slug, col.name, col.description, col.sortOrder, COUNT(g.id), col.createdAt, col.updatedAt
+		FROM collections col
+		LEFT JOIN collection_games cg ON cg.collectionId = col.id
+		LEFT JOIN games g ON g.id = cg.gameId AND g.retiredAt IS NULL AND `+visible+`
+		GROUP BY col.id
+		ORDER BY col.sortOrder ASC, col.name ASC
+	`, visibleArgs...)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer rows.Close()
+
+	collections := []Collection{}
+	for rows.Next() {
+		var collection Collection
+		if err := rows.Scan(&collection.Id, &collection.Slug, &collection.Name, &collection.Description, &collection.SortOrder, &collection.GameCount, &collection.CreatedAt, &collection.UpdatedAt); err != nil {
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		collections = append(collections, collection)
+	}
+
+	return c.JSON(fiber.Map{"collections": collections})
+}
+
+// getCollection loads a collection, counting only the games that match the visible condition from catalogVisibility
+func getCollection(db *sql.DB, slug string, visible string, visibleArgs []interface{}) (Collection, error) {
+	var collection Collection
+	err := db.QueryRow(`
+		SELECT col.id, col.slug, col.name, col.description, col.sortOrder, COUNT(g.id), col.createdAt, col.updatedAt
+		FROM collections col
+		LEFT JOIN collection_games cg ON cg.collectionId = col.id
+		LEFT JOIN games g ON g.id = cg.gameId AND g.retiredAt IS NULL AND `+visible+`
+		WHERE col.slug = ?
+		GROUP BY col.id
+	`, append(visibleArgs, slug)...).Scan(&collection.Id, &collection.Slug, &collection.Name, &collection.Description, &collection.SortOrder, &collection.GameCount, &collection.CreatedAt, &collection.UpdatedAt)
+	return collection, err
+}
+
+/**
+ * GetCollection returns a collection and its games in curated order
+ * Games go through the same access and parental filtering as the catalog
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetCollection(c *fiber.Ctx, db *sql.DB) error {
+	userId := GetOptionalUserId(c)
+	userTier := GetUserTier(db, userId)
+
+	controls, err := GetParentalControls(db, userId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	visible, visibleArgs := catalogVisibility(userId, userTier, controls)
+	collection, err := getCollection(db, c.Params("slug"), visible, visibleArgs)
+	if err == sql.ErrNoRows {
+		return ErrorResponse(c, 404, "Collection not found")
+	}
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	query, err := ParseCatalogQuery(c, collection.Slug)
+	if err != nil {
+		return ErrorResponse(c, 400, err.Error())
+	}
+
+	games, nextCursor, err := QueryCatalog(db, userId, userTier, controls, query)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	return c.JSON(fiber.Map{"collection": collection, "games": games, "userTier": userTier, "isAuthenticated": userId != "", "nextCursor": nextCursor})
+}
+
+/**
+ * lookupGameIds resolves game slugs to ids, failing on the first unknown slug
+ */
+func lookupGameIds(tx *sql.Tx, slugs []string) ([]string, error) {
+	ids := make([]string, 0, len(slugs))
+	for _, slug := range slugs {
+		var id string
+		err := tx.QueryRow("SELECT id FROM games WHERE slug = ?", slug).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Unknown game: "+slug)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+/**
+ * SaveCollection creates a collection, or replaces its metadata and game list (admin only)
+ * Used for POST /admin/collections and PUT /admin/collections/:slug
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func SaveCollection(c *fiber.Ctx, db *sql.DB) error {
+	var collectionReq CollectionRequest
+	if err := c.BodyParser(&collectionReq); err != nil {
+		return ErrorResponse(c, 400, "Invalid request body")
+	}
+
+	existingSlug := c.Params("slug")
+	if existingSlug != "" && collectionReq.Slug == "" {
+		collectionReq.Slug = existingSlug
+	}
+	if !ValidateSlug(collectionReq.Slug) {
+		return ErrorResponse(c, 400, "Invalid slug")
+	}
+	if strings.TrimSpace(collectionReq.Name) == "" {
+		return ErrorResponse(c, 400, "Name is required")
+	}
+
+	seen := map[string]bool{}
+	for _, slug := range collectionReq.Games {
+		if seen[slug] {
+			return ErrorResponse(c, 400, "Duplicate game in collection: "+slug)
+		}
+		seen[slug] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	gameIds, err := lookupGameIds(tx, collectionReq.Games)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	var collectionId string
+	status := 200
+	if existingSlug == "" {
+		collectionId = uuid.New().String()
+		_, err = tx.Exec(`
+			INSERT INTO collections(id, slug, name, description, sortOrder) VALUES (?, ?, ?, ?, ?)
+		`, collectionId, collectionReq.Slug, collectionReq.Name, collectionReq.Description, collectionReq.SortOrder)
+		status = 201
+	} else {
+		err = tx.QueryRow("SELECT id FROM collections WHERE slug = ?", existingSlug).Scan(&collectionId)
+		if err == sql.ErrNoRows {
+			return ErrorResponse(c, 404, "Collection not found")
+		}
+		if err == nil {
+			_, err = tx.Exec(`
+				UPDATE collections SET slug = ?, name = ?, description = ?, sortOrder = ?, updatedAt = CURRENT_TIMESTAMP
+				WHERE id = ?
+			`, collectionReq.Slug, collectionReq.Name, collectionReq.Description, collectionReq.SortOrder, collectionId)
+		}
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return ErrorResponse(c, 409, "Collection slug already exists")
+		}
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM collection_games WHERE collectionId = ?", collectionId); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	for position, gameId := range gameIds {
+		_, err := tx.Exec("INSERT INTO collection_games(collectionId, gameId, position) VALUES (?, ?, ?)", collectionId, gameId, position)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	// Admins see how many games the collection holds, whatever their own catalog shows
+	collection, err := getCollection(db, collectionReq.Slug, "1", nil)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	return c.Status(status).JSON(collection)
+}
+
+/**
+ * DeleteCollection removes a collection (admin only)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func DeleteCollection(c *fiber.Ctx, db *sql.DB) error {
+	result, err := db.Exec("DELETE FROM collections WHERE slug = ?", c.Params("slug"))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrorResponse(c, 404, "Collection not found")
+	}
+	return c.JSON(fiber.Map{"message": "Collection deleted"})
+}
+
+/**
+ * CreateCategory adds a category (admin only)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func CreateCategory(c *fiber.Ctx, db *sql.DB) error {
+	var category Category
+	if err := c.BodyParser(&category); err != nil {
+		return ErrorResponse(c, 400, "Invalid request body")
+	}
+	if !ValidateSlug(category.Slug) {
+		return ErrorResponse(c, 400, "Invalid slug")
+	}
+	if strings.TrimSpace(category.Name) == "" {
+		return ErrorResponse(c, 400, "Name is required")
+	}
+
+	category.Id = uuid.New().String()
+	_, err := db.Exec("INSERT INTO categories(id, slug, name, sortOrder) VALUES (?, ?, ?, ?)", category.Id, category.Slug, category.Name, category.SortOrder)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return ErrorResponse(c, 409, "Category slug already exists")
+		}
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	return c.Status(201).JSON(category)
+}
+
+/**
+ * DeleteCategory removes a category and its game assignments (admin only)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func DeleteCategory(c *fiber.Ctx, db *sql.DB) error {
+	result, err := db.Exec("DELETE FROM categories WHERE slug = ?", c.Params("slug"))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrorResponse(c, 404, "Category not found")
+	}
+	return c.JSON(fiber.Map{"message": "Category deleted"})
+}
+
+/**
+ * SetGameTaxonomy replaces a game's categories and tags (admin only)
+ * Tags are free-form but normalised to lowercase slugs
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func SetGameTaxonomy(c *fiber.Ctx, db *sql.DB) error {
+	var taxonomy struct {
+		Categories []string `json:"categories"`
+		Tags       []string `json:"tags"`
+	}
+	if err := c.BodyParser(&taxonomy); err != nil {
+		return ErrorResponse(c, 400, "Invalid request body")
+	}
+
+	tags := []string{}
+	seenTags := map[string]bool{}
+	for _, tag := range taxonomy.Tags {
+		tag = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(tag)), " ", "-")
+		if !ValidateSlug(tag) {
+			return ErrorResponse(c, 400, "Invalid tag: "+tag)
+		}
+		if !seenTags[tag] {
+			seenTags[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	gameIds, err := lookupGameIds(tx, []string{c.Params("slug")})
+	if err != nil {
+		if fiberErr, ok := err.(*fiber.Error); ok && fiberErr.Code == fiber.StatusBadRequest {
+			return ErrorResponse(c, 404, "Game not found")
+		}
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	gameId := gameIds[0]
+
+	if taxonomy.Categories != nil {
+		if _, err := tx.Exec("DELETE FROM game_categories WHERE gameId = ?", gameId); err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		for _, slug := range taxonomy.Categories {
+			result, err := tx.Exec(`
+				INSERT OR IGNORE INTO game_categories(gameId, categoryId)
+				SELECT ?, id FROM categories WHERE slug = ?
+			`, gameId, slug)
+			if err != nil {
+				return StandardErrorResponse(c, 500, "Database error", err)
+			}
+			var count int
+			if affected, _ := result.RowsAffected(); affected == 0 {
+				tx.QueryRow("SELECT COUNT(*) FROM categories WHERE slug = ?", slug).Scan(&count)
+				if count == 0 {
+					return ErrorResponse(c, 400, "Unknown category: "+slug)
+				}
+			}
+		}
+	}
+
+	if taxonomy.Tags != nil {
+		if _, err := tx.Exec("DELETE FROM game_tags WHERE gameId = ?", gameId); err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		for _, tag := range tags {
+			if _, err := tx.Exec("INSERT INTO game_tags(gameId, tag) VALUES (?, ?)", gameId, tag); err != nil {
+				return StandardErrorResponse(c, 500, "Database error", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	return c.JSON(fiber.Map{"categories": taxonomy.Categories, "tags": tags})
+}
+
+/**
+ * GetMyFavorites lists the current user's favorite games
+ * Accepts the same filters and pagination as the catalog
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetMyFavorites(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+	userTier := GetUserTier(db, userId)
+
+	query, err := ParseCatalogQuery(c, c.Query("collection"))
+	if err != nil {
+		return ErrorResponse(c, 400, err.Error())
+	}
+	query.Favorites = true
+	query.IncludeLocked = true
+
+	controls, err := GetParentalControls(db, userId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	games, nextCursor, err := QueryCatalog(db, userId, userTier, controls, query)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	return c.JSON(fiber.Map{"games": games, "userTier": userTier, "nextCursor": nextCursor})
+}
+
+/**
+ * AddFavorite marks a game as a favorite for the current user
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func AddFavorite(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+
+	result, err := db.Exec(`
+		INSERT OR IGNORE INTO user_favorites(userId, gameId)
+		SELECT ?, id FROM games WHERE slug = ?
+	`, userId, c.Params("slug"))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM games WHERE slug = ?", c.Params("slug")).Scan(&count)
+		if count == 0 {
+			return ErrorResponse(c, 404, "Game not found")
+		}
+	}
+
+	return c.JSON(fiber.Map{"gameSlug": c.Params("slug"), "favorite": true})
+}
+
+/**
+ * RemoveFavorite removes a game from the current user's favorites
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func RemoveFavorite(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+
+	_, err := db.Exec(`
+		DELETE FROM user_favorites
+		WHERE userId = ? AND gameId = (SELECT id FROM games WHERE slug = ?)
+	`, userId, c.Params("slug"))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	return c.JSON(fiber.Map{"gameSlug": c.Params("slug"), "favorite": false})
+}
@@ -2,18 +2,27 @@ package api
 
 import (
 	"database/sql"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
 	"time"
 )
 
+/**
+ * FullTextSearchEnabled reports whether the games_fts FTS5 index is available
+ * FTS5 requires building with -tags sqlite_fts5; catalog search falls back to LIKE without it
+ */
+var FullTextSearchEnabled bool
+
 /**
  * InitializeDatabase creates and configures the database connection
  * @param {string} dbPath - Path to the SQLite database file
  * @returns {*sql.DB} Database connection object
  */
 func InitializeDatabase(dbPath string) *sql.DB {
-	connectionString := dbPath + "?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=ON"
+	// Transactions take the write lock up front, so two read-modify-write transactions
+	// queue on the busy timeout instead of failing when the second tries to write
+	connectionString := dbPath + "?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=ON&_txlock=immediate"
 
 	db, err := sql.Open("sqlite3", connectionString)
 	if err != nil {
@@ -50,12 +59,23 @@ func InitializeDatabase(dbPath string) *sql.DB {
 			createdDate TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			modifiedDate TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			deletedDate TIMESTAMP,
-			isDeleted INTEGER DEFAULT 0
+			isDeleted INTEGER DEFAULT 0,
+			parentUserId TEXT REFERENCES users(id),
+			isAdmin INTEGER DEFAULT 0
 		)`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Columns added after the initial schema need explicit migrations for existing databases
+	if err = addColumnIfNotExists(db, "users", "parentUserId", "TEXT REFERENCES users(id)"); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = addColumnIfNotExists(db, "users", "isAdmin", "INTEGER DEFAULT 0"); err != nil {
+		log.Fatal(err)
+	}
+
 	// Create sessions table
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS sessions(
@@ -110,6 +130,10 @@ func InitializeDatabase(dbPath string) *sql.DB {
 			tierRequired TEXT NOT NULL DEFAULT 'free',
 			manifestPath TEXT NOT NULL,
 			sizeBytes INTEGER DEFAULT 0,
+			rating TEXT NOT NULL DEFAULT 'everyone',
+			contentHash TEXT DEFAULT '',
+			retiredAt TIMESTAMP,
+			liveReleaseId TEXT,
 			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`)
@@ -117,6 +141,55 @@ func InitializeDatabase(dbPath string) *sql.DB {
 		log.Fatal(err)
 	}
 
+	if err = addColumnIfNotExists(db, "games", "rating", "TEXT NOT NULL DEFAULT 'everyone'"); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = addColumnIfNotExists(db, "games", "contentHash", "TEXT DEFAULT ''"); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = addColumnIfNotExists(db, "games", "retiredAt", "TIMESTAMP"); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = addColumnIfNotExists(db, "games", "liveReleaseId", "TEXT"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create game_releases table (one immutable row per uploaded game version)
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS game_releases(
+			id TEXT PRIMARY KEY,
+			gameId TEXT NOT NULL,
+			version TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'draft',
+			manifestPath TEXT NOT NULL,
+			sizeBytes INTEGER DEFAULT 0,
+			contentHash TEXT DEFAULT '',
+			manifestJson TEXT DEFAULT '',
+			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			publishedAt TIMESTAMP,
+			UNIQUE (gameId, version),
+			FOREIGN KEY (gameId) REFERENCES games(id) ON DELETE CASCADE
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = addColumnIfNotExists(db, "game_releases", "manifestJson", "TEXT DEFAULT ''"); err != nil {
+		log.Fatal(err)
+	}
+
+	// publishedAt used to be written in Go's time format, which does not sort against CURRENT_TIMESTAMP values
+	_, err = db.Exec(`
+		UPDATE game_releases SET publishedAt = datetime(publishedAt)
+		WHERE publishedAt IS NOT NULL AND publishedAt != datetime(publishedAt)
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_games_slug ON games(slug)`)
 	if err != nil {
 		log.Fatal(err)
@@ -127,6 +200,90 @@ func InitializeDatabase(dbPath string) *sql.DB {
 		log.Fatal(err)
 	}
 
+	// Create categories and the many-to-many game_categories/game_tags tables
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS categories(
+			id TEXT PRIMARY KEY,
+			slug TEXT UNIQUE NOT NULL,
+			name TEXT NOT NULL,
+			sortOrder INTEGER DEFAULT 0
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS game_categories(
+			gameId TEXT NOT NULL,
+			categoryId TEXT NOT NULL,
+			PRIMARY KEY (gameId, categoryId),
+			FOREIGN KEY (gameId) REFERENCES games(id) ON DELETE CASCADE,
+			FOREIGN KEY (categoryId) REFERENCES categories(id) ON DELETE CASCADE
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS game_tags(
+			gameId TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (gameId, tag),
+			FOREIGN KEY (gameId) REFERENCES games(id) ON DELETE CASCADE
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_game_tags_tag ON game_tags(tag)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create collections tables (admin-curated, ordered game lists)
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS collections(
+			id TEXT PRIMARY KEY,
+			slug TEXT UNIQUE NOT NULL,
+			name TEXT NOT NULL,
+			description TEXT DEFAULT '',
+			sortOrder INTEGER DEFAULT 0,
+			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS collection_games(
+			collectionId TEXT NOT NULL,
+			gameId TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			PRIMARY KEY (collectionId, gameId),
+			FOREIGN KEY (collectionId) REFERENCES collections(id) ON DELETE CASCADE,
+			FOREIGN KEY (gameId) REFERENCES games(id) ON DELETE CASCADE
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create user_favorites table
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_favorites(
+			userId TEXT NOT NULL,
+			gameId TEXT NOT NULL,
+			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (userId, gameId),
+			FOREIGN KEY (userId) REFERENCES users(id),
+			FOREIGN KEY (gameId) REFERENCES games(id) ON DELETE CASCADE
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	FullTextSearchEnabled = initializeGameSearch(db)
+
 	// Create user_progression table
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS user_progression(
@@ -142,5 +299,465 @@ func InitializeDatabase(dbPath string) *sql.DB {
 		log.Fatal(err)
 	}
 
+	// Create game_entitlements table (per-game access independent of subscription tier)
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS game_entitlements(
+			id TEXT PRIMARY KEY,
+			userId TEXT NOT NULL,
+			gameId TEXT NOT NULL,
+			source TEXT NOT NULL,
+			reference TEXT UNIQUE,
+			grantedBy TEXT,
+			expiresAt TIMESTAMP,
+			revokedAt TIMESTAMP,
+			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (userId) REFERENCES users(id),
+			FOREIGN KEY (gameId) REFERENCES games(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_game_entitlements_userId_gameId ON game_entitlements(userId, gameId)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create parental_controls table (one row per child account)
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS parental_controls(
+			userId TEXT PRIMARY KEY,
+			parentUserId TEXT NOT NULL,
+			maxRating TEXT NOT NULL DEFAULT 'everyone',
+			allowedGames TEXT DEFAULT '[]',
+			blockedGames TEXT DEFAULT '[]',
+			dailyMinutes INTEGER DEFAULT 0,
+			allowedStartHour INTEGER DEFAULT 0,
+			allowedEndHour INTEGER DEFAULT 24,
+			timezone TEXT NOT NULL DEFAULT 'UTC',
+			updatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (userId) REFERENCES users(id),
+			FOREIGN KEY (parentUserId) REFERENCES users(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_parental_controls_parentUserId ON parental_controls(parentUserId)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create play_sessions table for play-time accounting
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS play_sessions(
+			id TEXT PRIMARY KEY,
+			userId TEXT NOT NULL,
+			gameSlug TEXT NOT NULL,
+			playDate TEXT NOT NULL,
+			startedAt TIMESTAMP NOT NULL,
+			seconds INTEGER NOT NULL DEFAULT 0,
+			lastHeartbeatAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (userId) REFERENCES users(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_play_sessions_userId_playDate ON play_sessions(userId, playDate)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create play_session_days table; a session's seconds split by the server day they were reported on
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS play_session_days(
+			sessionId TEXT NOT NULL,
+			userId TEXT NOT NULL,
+			playDate TEXT NOT NULL,
+			seconds INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (sessionId, playDate),
+			FOREIGN KEY (sessionId) REFERENCES play_sessions(id),
+			FOREIGN KEY (userId) REFERENCES users(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_play_session_days_userId_playDate ON play_session_days(userId, playDate)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Sessions recorded before the split keep all their seconds on the day they were stored under
+	_, err = db.Exec(`
+		INSERT OR IGNORE INTO play_session_days(sessionId, userId, playDate, seconds)
+		SELECT id, userId, playDate, seconds FROM play_sessions
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create progression_earnings table; each row is what one sync awarded, summed to enforce earning limits
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS progression_earnings(
+			id TEXT PRIMARY KEY,
+			userId TEXT NOT NULL,
+			gameSlug TEXT NOT NULL DEFAULT '',
+			sessionId TEXT NOT NULL DEFAULT '',
+			coins INTEGER NOT NULL DEFAULT 0,
+			xp INTEGER NOT NULL DEFAULT 0,
+			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (userId) REFERENCES users(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_progression_earnings_userId_createdAt ON progression_earnings(userId, createdAt)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_progression_earnings_sessionId ON progression_earnings(sessionId)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create progression_anomalies table for syncs that were clamped or rejected
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS progression_anomalies(
+			id TEXT PRIMARY KEY,
+			userId TEXT NOT NULL,
+			gameSlug TEXT NOT NULL DEFAULT '',
+			sessionId TEXT NOT NULL DEFAULT '',
+			field TEXT NOT NULL DEFAULT '',
+			kind TEXT NOT NULL,
+			requested INTEGER NOT NULL DEFAULT 0,
+			accepted INTEGER NOT NULL DEFAULT 0,
+			earningLimit INTEGER NOT NULL DEFAULT 0,
+			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			reviewedAt TIMESTAMP,
+			reviewedBy TEXT,
+			FOREIGN KEY (userId) REFERENCES users(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_progression_anomalies_reviewedAt ON progression_anomalies(reviewedAt, createdAt)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = addColumnIfNotExists(db, "progression_anomalies", "itemId", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create progression_events table; one row per applied sync batch, so retried batches are not applied twice
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS progression_events(
+			id TEXT PRIMARY KEY,
+			userId TEXT NOT NULL,
+			batchId TEXT NOT NULL,
+			deviceId TEXT NOT NULL DEFAULT '',
+			gameSlug TEXT NOT NULL DEFAULT '',
+			sessionId TEXT NOT NULL DEFAULT '',
+			coinsEarned INTEGER NOT NULL DEFAULT 0,
+			xpEarned INTEGER NOT NULL DEFAULT 0,
+			response TEXT,
+			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(userId, batchId),
+			FOREIGN KEY (userId) REFERENCES users(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Per-device sequence number of each batch, so batches arriving late or reusing a number are recognised
+	if err = addColumnIfNotExists(db, "progression_events", "sequence", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_progression_events_sequence ON progression_events(userId, deviceId, sequence)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create progression_devices table; each device's highest sequence number and the last ledger entry it was sent
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS progression_devices(
+			userId TEXT NOT NULL,
+			deviceId TEXT NOT NULL,
+			lastSequence INTEGER NOT NULL DEFAULT 0,
+			lastLedgerId INTEGER NOT NULL DEFAULT 0,
+			lastSyncedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (userId, deviceId),
+			FOREIGN KEY (userId) REFERENCES users(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create progression_ledger table; every change to a user's progression, never updated or deleted
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS progression_ledger(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			userId TEXT NOT NULL,
+			gameSlug TEXT NOT NULL DEFAULT '',
+			deviceId TEXT NOT NULL DEFAULT '',
+			batchId TEXT NOT NULL DEFAULT '',
+			kind TEXT NOT NULL,
+			itemId TEXT NOT NULL DEFAULT '',
+			delta INTEGER NOT NULL,
+			reason TEXT NOT NULL,
+			clientTimestamp TEXT NOT NULL DEFAULT '',
+			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (userId) REFERENCES users(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_progression_ledger_userId ON progression_ledger(userId, id)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, trigger := range []string{
+		`CREATE TRIGGER IF NOT EXISTS progression_ledger_no_update BEFORE UPDATE ON progression_ledger BEGIN
+			SELECT RAISE(ABORT, 'progression_ledger is append-only');
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS progression_ledger_no_delete BEFORE DELETE ON progression_ledger BEGIN
+			SELECT RAISE(ABORT, 'progression_ledger is append-only');
+		END`,
+	} {
+		if _, err = db.Exec(trigger); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err = recordOpeningBalances(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create achievements table; the catalog each game declares in its live release's manifest
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS achievements(
+			gameSlug TEXT NOT NULL,
+			id TEXT NOT NULL,
+			title TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			icon TEXT NOT NULL DEFAULT '',
+			hidden INTEGER NOT NULL DEFAULT 0,
+			points INTEGER NOT NULL DEFAULT 0,
+			xpReward INTEGER NOT NULL DEFAULT 0,
+			coinReward INTEGER NOT NULL DEFAULT 0,
+			retiredAt TIMESTAMP,
+			updatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (gameSlug, id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create game_progression table; per-game XP, achievements, unlocks and state alongside the global totals
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS game_progression(
+			userId TEXT NOT NULL,
+			gameSlug TEXT NOT NULL,
+			xp INTEGER NOT NULL DEFAULT 0,
+			achievements TEXT NOT NULL DEFAULT '[]',
+			unlockedItems TEXT NOT NULL DEFAULT '[]',
+			state TEXT NOT NULL DEFAULT '{}',
+			updatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (userId, gameSlug),
+			FOREIGN KEY (userId) REFERENCES users(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create game_saves table; cloud save slots, keeping the latest few revisions of each
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS game_saves(
+			userId TEXT NOT NULL,
+			gameSlug TEXT NOT NULL,
+			slot TEXT NOT NULL,
+			revision INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			sizeBytes INTEGER NOT NULL,
+			contentType TEXT NOT NULL DEFAULT 'application/octet-stream',
+			deviceId TEXT NOT NULL DEFAULT '',
+			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (userId, gameSlug, slot, revision),
+			FOREIGN KEY (userId) REFERENCES users(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create game_save_slots table; the last revision given out per slot, kept when the slot is deleted
+	// so a recreated slot never reuses a revision an old If-Match could still name
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS game_save_slots(
+			userId TEXT NOT NULL,
+			gameSlug TEXT NOT NULL,
+			slot TEXT NOT NULL,
+			lastRevision INTEGER NOT NULL,
+			PRIMARY KEY (userId, gameSlug, slot),
+			FOREIGN KEY (userId) REFERENCES users(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create levels table; an empty table means the default level curve is used
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS levels(
+			level INTEGER PRIMARY KEY,
+			xpRequired INTEGER NOT NULL,
+			coinReward INTEGER NOT NULL DEFAULT 0,
+			rewardItems TEXT NOT NULL DEFAULT '[]'
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create store_items table; items bought with coins, which end up in unlockedItems
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS store_items(
+			id TEXT PRIMARY KEY,
+			title TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			price INTEGER NOT NULL,
+			tierRequired TEXT NOT NULL DEFAULT 'free',
+			gameSlug TEXT NOT NULL DEFAULT '',
+			stock INTEGER,
+			sold INTEGER NOT NULL DEFAULT 0,
+			availableFrom TEXT NOT NULL DEFAULT '',
+			availableUntil TEXT NOT NULL DEFAULT '',
+			retiredAt TIMESTAMP,
+			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updatedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create store_purchases table; the integer id orders a user's purchase history
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS store_purchases(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			userId TEXT NOT NULL,
+			itemId TEXT NOT NULL,
+			gameSlug TEXT NOT NULL DEFAULT '',
+			price INTEGER NOT NULL,
+			createdAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(userId, itemId),
+			FOREIGN KEY (userId) REFERENCES users(id),
+			FOREIGN KEY (itemId) REFERENCES store_items(id)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Highest level whose rewards have been granted; 0 until the user's first sync after levels were added
+	if err = addColumnIfNotExists(db, "user_progression", "level", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		log.Fatal(err)
+	}
+
 	return db
 }
+
+/**
+ * initializeGameSearch creates the games_fts index and the triggers that keep it in sync
+ * The index is rebuilt on startup so rows written before it existed are searchable
+ * @param {*sql.DB} db - Database connection
+ * @returns {bool} True if FTS5 is available
+ */
+func initializeGameSearch(db *sql.DB) bool {
+	_, err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS games_fts USING fts5(name, description, content='games', content_rowid='rowid')`)
+	if err == nil {
+		// An existing games_fts table is not re-checked by CREATE, so probe that the module loads
+		_, err = db.Exec(`SELECT rowid FROM games_fts LIMIT 1`)
+	}
+	if err != nil {
+		log.Printf("Warning: FTS5 unavailable, game search will use LIKE (build with -tags sqlite_fts5 to enable it): %v", err)
+		// Triggers left by an FTS5-enabled build would make every write to games fail
+		for _, trigger := range []string{"games_fts_insert", "games_fts_delete", "games_fts_update"} {
+			if _, err := db.Exec("DROP TRIGGER IF EXISTS " + trigger); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return false
+	}
+
+	triggers := []string{
+		`CREATE TRIGGER IF NOT EXISTS games_fts_insert AFTER INSERT ON games BEGIN
+			INSERT INTO games_fts(rowid, name, description) VALUES (new.rowid, new.name, new.description);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS games_fts_delete AFTER DELETE ON games BEGIN
+			INSERT INTO games_fts(games_fts, rowid, name, description) VALUES ('delete', old.rowid, old.name, old.description);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS games_fts_update AFTER UPDATE ON games BEGIN
+			INSERT INTO games_fts(games_fts, rowid, name, description) VALUES ('delete', old.rowid, old.name, old.description);
+			INSERT INTO games_fts(rowid, name, description) VALUES (new.rowid, new.name, new.description);
+		END`,
+	}
+	for _, trigger := range triggers {
+		if _, err := db.Exec(trigger); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if _, err := db.Exec(`INSERT INTO games_fts(games_fts) VALUES ('rebuild')`); err != nil {
+		log.Printf("Warning: Failed to rebuild game search index: %v", err)
+	}
+
+	return true
+}
+
+/**
+ * queryer is satisfied by both *sql.DB and *sql.Tx
+ */
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+/**
+ * addColumnIfNotExists adds a column to an existing table when it is missing
+ * SQLite has no ADD COLUMN IF NOT EXISTS, so the table info is checked first
+ * @param {*sql.DB} db - Database connection
+ * @param {string} table - Table name
+ * @param {string} column - Column name
+ * @param {string} definition - Column type and constraints
+ * @returns {error} Error if any
+ */
+func addColumnIfNotExists(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
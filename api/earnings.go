@@ -0,0 +1,461 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+/**
+ * EarningLimits caps how many coins and how much XP a game can award
+ * Declared as earningLimits in manifest.json; fields left out use DefaultEarningLimits
+ * Per-minute limits are measured against play time reported by session heartbeats
+ */
+type EarningLimits struct {
+	CoinsPerMinute  int `json:"coinsPerMinute,omitempty"`
+	XpPerMinute     int `json:"xpPerMinute,omitempty"`
+	CoinsPerSession int `json:"coinsPerSession,omitempty"`
+	XpPerSession    int `json:"xpPerSession,omitempty"`
+	CoinsPerDay     int `json:"coinsPerDay,omitempty"`
+	XpPerDay        int `json:"xpPerDay,omitempty"`
+}
+
+// DefaultEarningLimits apply to games that declare no earningLimits and to syncs that name no game
+var DefaultEarningLimits = EarningLimits{
+	CoinsPerMinute:  100,
+	XpPerMinute:     200,
+	CoinsPerSession: 5000,
+	XpPerSession:    10000,
+	CoinsPerDay:     20000,
+	XpPerDay:        40000,
+}
+
+const (
+	AnomalyNegativeDelta   = "negative_delta"
+	AnomalyExcessiveDelta  = "excessive_delta"
+	AnomalyRateLimit       = "rate_limit"
+	AnomalySessionLimit    = "session_limit"
+	AnomalyDailyLimit      = "daily_limit"
+	AnomalyUnknownGame     = "unknown_game"
+	AnomalyUnknownSession  = "unknown_session"
+	AnomalySessionMismatch = "session_mismatch"
+	AnomalyTotalDailyLimit = "total_daily_limit"
+)
+
+// TotalDailyEarningLimits cap what a player can earn across all games together in a day,
+// on top of each game's own daily limit
+var TotalDailyEarningLimits = EarningLimits{
+	CoinsPerDay: 50000,
+	XpPerDay:    100000,
+}
+
+// The daily window is rolling so it does not depend on the player's timezone
+const earningDayWindow = 24 * time.Hour
+
+/**
+ * EarningAdjustment records one way a sync was changed from what the client asked for
+ */
+type EarningAdjustment struct {
+	Field     string `json:"field,omitempty"`
+	Kind      string `json:"kind"`
+	Item      string `json:"item,omitempty"`
+	Requested int    `json:"requested"`
+	Accepted  int    `json:"accepted"`
+	Limit     int    `json:"limit"`
+}
+
+/**
+ * EarningResult is what a progression sync was allowed to award
+ */
+type EarningResult struct {
+	CoinsEarned int                 `json:"coinsEarned"`
+	XpEarned    int                 `json:"xpEarned"`
+	Adjustments []EarningAdjustment `json:"adjustments"`
+	// Anomaly kind when the whole sync was refused, e.g. for an unknown game or session
+	Rejected string `json:"rejected,omitempty"`
+}
+
+/**
+ * ProgressionAnomaly is a stored adjustment, kept for admins to review
+ */
+type ProgressionAnomaly struct {
+	Id        string `json:"id"`
+	UserId    string `json:"userId"`
+	GameSlug  string `json:"gameSlug,omitempty"`
+	SessionId string `json:"sessionId,omitempty"`
+	EarningAdjustment
+	CreatedAt  string `json:"createdAt"`
+	ReviewedAt string `json:"reviewedAt,omitempty"`
+	ReviewedBy string `json:"reviewedBy,omitempty"`
+}
+
+/**
+ * withDefaults fills in every limit the manifest left out
+ */
+func (limits EarningLimits) withDefaults() EarningLimits {
+	pick := func(value int, fallback int) int {
+		if value > 0 {
+			return value
+		}
+		return fallback
+	}
+	return EarningLimits{
+		CoinsPerMinute:  pick(limits.CoinsPerMinute, DefaultEarningLimits.CoinsPerMinute),
+		XpPerMinute:     pick(limits.XpPerMinute, DefaultEarningLimits.XpPerMinute),
+		CoinsPerSession: pick(limits.CoinsPerSession, DefaultEarningLimits.CoinsPerSession),
+		XpPerSession:    pick(limits.XpPerSession, DefaultEarningLimits.XpPerSession),
+		CoinsPerDay:     pick(limits.CoinsPerDay, DefaultEarningLimits.CoinsPerDay),
+		XpPerDay:        pick(limits.XpPerDay, DefaultEarningLimits.XpPerDay),
+	}
+}
+
+func checkEarningLimits(limits *EarningLimits) []string {
+	if limits == nil {
+		return nil
+	}
+	problems := []string{}
+	fields := []struct {
+		name  string
+		value int
+	}{
+		{"coinsPerMinute", limits.CoinsPerMinute}, {"xpPerMinute", limits.XpPerMinute},
+		{"coinsPerSession", limits.CoinsPerSession}, {"xpPerSession", limits.XpPerSession},
+		{"coinsPerDay", limits.CoinsPerDay}, {"xpPerDay", limits.XpPerDay},
+	}
+	for _, field := range fields {
+		if field.value < 0 {
+			problems = append(problems, fmt.Sprintf("earningLimits.%s cannot be negative", field.name))
+		}
+	}
+	return problems
+}
+
+/**
+ * loadEarningLimits reads a game's limits from the manifest of its live release
+ * @returns {EarningLimits} Limits with defaults filled in
+ * @returns {bool} False if no game has this slug
+ * @returns {error} Error if any
+ */
+func loadEarningLimits(db queryer, gameSlug string) (EarningLimits, bool, error) {
+	var storedManifest string
+	err := db.QueryRow(`
+		SELECT COALESCE(r.manifestJson, '') FROM games g
+		LEFT JOIN game_releases r ON r.id = g.liveReleaseId
+		WHERE g.slug = ?
+	`, gameSlug).Scan(&storedManifest)
+	if err == sql.ErrNoRows {
+		return DefaultEarningLimits, false, nil
+	}
+	if err != nil {
+		return EarningLimits{}, false, err
+	}
+
+	var manifest GameManifestV2
+	if storedManifest == "" || json.Unmarshal([]byte(storedManifest), &manifest) != nil || manifest.EarningLimits == nil {
+		return DefaultEarningLimits, true, nil
+	}
+	return manifest.EarningLimits.withDefaults(), true, nil
+}
+
+/**
+ * earningWindow is what the player has already played and earned in the windows the limits cover
+ */
+type earningWindow struct {
+	playSeconds int
+	// Earnings over the same play time as playSeconds, for the per-minute limit
+	playCoins, playXp       int
+	sessionCoins, sessionXp int
+	dayCoins, dayXp         int
+	// Earnings across every game in the same day, for TotalDailyEarningLimits
+	totalDayCoins, totalDayXp int
+	hasSession                bool
+}
+
+/**
+ * EvaluateEarnings works out how much of a sync request may be awarded
+ * Negative deltas and single deltas larger than a whole day's limit are rejected, as is
+ * everything in a sync that names an unknown game or a session the user never reported;
+ * anything else over a per-minute, per-session or per-day limit is clamped to it
+ * @param {queryer} db - Database connection or the sync's transaction
+ * @param {string} userId - User ID
+ * @param {ProgressionSyncRequest} syncReq - Deltas the client reported
+ * @param {time.Time} now - Current time
+ * @returns {EarningResult} Accepted amounts and every adjustment made
+ * @returns {error} Error if any
+ */
+func EvaluateEarnings(db queryer, userId string, syncReq ProgressionSyncRequest, now time.Time) (EarningResult, error) {
+	result := EarningResult{Adjustments: []EarningAdjustment{}}
+
+	limits := DefaultEarningLimits
+	if syncReq.GameSlug != "" {
+		var found bool
+		var err error
+		limits, found, err = loadEarningLimits(db, syncReq.GameSlug)
+		if err != nil {
+			return result, err
+		}
+		if !found {
+			return rejectEarnings(result, syncReq, AnomalyUnknownGame), nil
+		}
+	}
+
+	window, status, err := loadEarningWindow(db, userId, syncReq, now)
+	if err != nil {
+		return result, err
+	}
+	// Play time is what earns the right to coins and XP, so a session without any earns nothing
+	if status != "" {
+		return rejectEarnings(result, syncReq, status), nil
+	}
+
+	// Heartbeats arrive once a minute, so allow the minute that has not been reported yet
+	playMinutes := (window.playSeconds+59)/60 + 1
+
+	var adjustments []EarningAdjustment
+	result.CoinsEarned, adjustments = capEarning("coins", syncReq.CoinsEarned, []earningCap{
+		{AnomalyRateLimit, limits.CoinsPerMinute * playMinutes, window.playCoins, true},
+		{AnomalySessionLimit, limits.CoinsPerSession, window.sessionCoins, window.hasSession},
+		{AnomalyDailyLimit, limits.CoinsPerDay, window.dayCoins, true},
+		{AnomalyTotalDailyLimit, TotalDailyEarningLimits.CoinsPerDay, window.totalDayCoins, true},
+	})
+	result.Adjustments = append(result.Adjustments, adjustments...)
+
+	result.XpEarned, adjustments = capEarning("xp", syncReq.XpEarned, []earningCap{
+		{AnomalyRateLimit, limits.XpPerMinute * playMinutes, window.playXp, true},
+		{AnomalySessionLimit, limits.XpPerSession, window.sessionXp, window.hasSession},
+		{AnomalyDailyLimit, limits.XpPerDay, window.dayXp, true},
+		{AnomalyTotalDailyLimit, TotalDailyEarningLimits.XpPerDay, window.totalDayXp, true},
+	})
+	result.Adjustments = append(result.Adjustments, adjustments...)
+
+	return result, nil
+}
+
+/**
+ * rejectEarnings refuses every coin and XP a sync asked for, flagging each field that asked for any
+ * @param {EarningResult} result - Result to add the adjustments to
+ * @param {ProgressionSyncRequest} syncReq - Deltas the client reported
+ * @param {string} kind - Why the sync earns nothing
+ * @returns {EarningResult} Result awarding nothing
+ */
+func rejectEarnings(result EarningResult, syncReq ProgressionSyncRequest, kind string) EarningResult {
+	result.CoinsEarned, result.XpEarned = 0, 0
+	result.Rejected = kind
+	if syncReq.CoinsEarned != 0 {
+		result.Adjustments = append(result.Adjustments, EarningAdjustment{Field: "coins", Kind: kind, Requested: syncReq.CoinsEarned})
+	}
+	if syncReq.XpEarned != 0 {
+		result.Adjustments = append(result.Adjustments, EarningAdjustment{Field: "xp", Kind: kind, Requested: syncReq.XpEarned})
+	}
+	return result
+}
+
+/**
+ * earningCap is one limit and how much of it has been used already
+ */
+type earningCap struct {
+	kind    string
+	limit   int
+	used    int
+	applies bool
+}
+
+func capEarning(field string, requested int, caps []earningCap) (int, []EarningAdjustment) {
+	if requested < 0 {
+		return 0, []EarningAdjustment{{Field: field, Kind: AnomalyNegativeDelta, Requested: requested}}
+	}
+
+	accepted := requested
+	adjustments := []EarningAdjustment{}
+	for _, limit := range caps {
+		if !limit.applies {
+			continue
+		}
+		if limit.kind == AnomalyDailyLimit && requested > limit.limit {
+			// No amount of play earns more than a day's limit in one sync
+			return 0, []EarningAdjustment{{Field: field, Kind: AnomalyExcessiveDelta, Requested: requested, Limit: limit.limit}}
+		}
+		remaining := max(limit.limit-limit.used, 0)
+		if accepted > remaining {
+			accepted = remaining
+			adjustments = append(adjustments, EarningAdjustment{Field: field, Kind: limit.kind, Requested: requested, Limit: limit.limit})
+		}
+	}
+
+	for i := range adjustments {
+		adjustments[i].Accepted = accepted
+	}
+	return accepted, adjustments
+}
+
+/**
+ * loadEarningWindow sums the play time and earnings the limits are measured against
+ * With a session, per-minute and per-session limits use that session; without one,
+ * the per-minute limit uses everything played in the last day
+ * @returns {earningWindow} Play time and earnings so far
+ * @returns {string} AnomalyUnknownSession or AnomalySessionMismatch if the session cannot earn anything, or empty
+ * @returns {error} Error if any
+ */
+func loadEarningWindow(db queryer, userId string, syncReq ProgressionSyncRequest, now time.Time) (earningWindow, string, error) {
+	var window earningWindow
+	dayStart := now.Add(-earningDayWindow).UTC().Format("2006-01-02 15:04:05")
+
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(coins), 0), COALESCE(SUM(xp), 0),
+			COALESCE(SUM(CASE WHEN gameSlug = ? THEN coins END), 0), COALESCE(SUM(CASE WHEN gameSlug = ? THEN xp END), 0)
+		FROM progression_earnings WHERE userId = ? AND createdAt > ?
+	`, syncReq.GameSlug, syncReq.GameSlug, userId, dayStart).Scan(&window.totalDayCoins, &window.totalDayXp, &window.dayCoins, &window.dayXp)
+	if err != nil {
+		return window, "", err
+	}
+	// Syncs that name no game are limited by everything earned that day
+	if syncReq.GameSlug == "" {
+		window.dayCoins, window.dayXp = window.totalDayCoins, window.totalDayXp
+	}
+
+	if syncReq.SessionId != "" {
+		window.hasSession = true
+		var sessionGame string
+		err := db.QueryRow("SELECT gameSlug, seconds FROM play_sessions WHERE id = ? AND userId = ?", syncReq.SessionId, userId).
+			Scan(&sessionGame, &window.playSeconds)
+		if err == sql.ErrNoRows {
+			return window, AnomalyUnknownSession, nil
+		}
+		if err != nil {
+			return window, "", err
+		}
+		if syncReq.GameSlug != "" && sessionGame != syncReq.GameSlug {
+			return window, AnomalySessionMismatch, nil
+		}
+
+		err = db.QueryRow(`
+			SELECT COALESCE(SUM(coins), 0), COALESCE(SUM(xp), 0) FROM progression_earnings
+			WHERE userId = ? AND sessionId = ?
+		`, userId, syncReq.SessionId).Scan(&window.sessionCoins, &window.sessionXp)
+		window.playCoins, window.playXp = window.sessionCoins, window.sessionXp
+		return window, "", err
+	}
+
+	playQuery := "SELECT COALESCE(SUM(seconds), 0) FROM play_sessions WHERE userId = ? AND lastHeartbeatAt > ?"
+	playArgs := []interface{}{userId, dayStart}
+	if syncReq.GameSlug != "" {
+		playQuery += " AND gameSlug = ?"
+		playArgs = append(playArgs, syncReq.GameSlug)
+	}
+	err = db.QueryRow(playQuery, playArgs...).Scan(&window.playSeconds)
+	window.playCoins, window.playXp = window.dayCoins, window.dayXp
+	return window, "", err
+}
+
+/**
+ * recordEarnings stores what a sync awarded and flags every adjustment for review
+ */
+func recordEarnings(db queryer, userId string, syncReq ProgressionSyncRequest, result EarningResult) error {
+	if result.CoinsEarned > 0 || result.XpEarned > 0 {
+		_, err := db.Exec(`
+			INSERT INTO progression_earnings(id, userId, gameSlug, sessionId, coins, xp)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, uuid.New().String(), userId, syncReq.GameSlug, syncReq.SessionId, result.CoinsEarned, result.XpEarned)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, adjustment := range result.Adjustments {
+		_, err := db.Exec(`
+			INSERT INTO progression_anomalies(id, userId, gameSlug, sessionId, field, kind, itemId, requested, accepted, earningLimit)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, uuid.New().String(), userId, syncReq.GameSlug, syncReq.SessionId, adjustment.Field, adjustment.Kind, adjustment.Item,
+			adjustment.Requested, adjustment.Accepted, adjustment.Limit)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * GetProgressionAnomalies lists flagged progression syncs, newest first (admin only)
+ * Query parameters: status (open, reviewed or all; default open), userId, gameSlug, limit
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetProgressionAnomalies(c *fiber.Ctx, db *sql.DB) error {
+	query := `
+		SELECT id, userId, gameSlug, sessionId, field, kind, itemId, requested, accepted, earningLimit,
+			createdAt, COALESCE(reviewedAt, ''), COALESCE(reviewedBy, '')
+		FROM progression_anomalies WHERE 1 = 1`
+	args := []interface{}{}
+
+	switch c.Query("status", "open") {
+	case "open":
+		query += " AND reviewedAt IS NULL"
+	case "reviewed":
+		query += " AND reviewedAt IS NOT NULL"
+	case "all":
+	default:
+		return ErrorResponse(c, 400, "status must be open, reviewed or all")
+	}
+	if userId := c.Query("userId"); userId != "" {
+		query += " AND userId = ?"
+		args = append(args, userId)
+	}
+	if gameSlug := c.Query("gameSlug"); gameSlug != "" {
+		query += " AND gameSlug = ?"
+		args = append(args, gameSlug)
+	}
+
+	limit := c.QueryInt("limit", 100)
+	if limit < 1 || limit > 500 {
+		limit = 100
+	}
+	query += " ORDER BY createdAt DESC, rowid DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer rows.Close()
+
+	anomalies := []ProgressionAnomaly{}
+	for rows.Next() {
+		var anomaly ProgressionAnomaly
+		err := rows.Scan(&anomaly.Id, &anomaly.UserId, &anomaly.GameSlug, &anomaly.SessionId, &anomaly.Field, &anomaly.Kind, &anomaly.Item,
+			&anomaly.Requested, &anomaly.Accepted, &anomaly.Limit, &anomaly.CreatedAt, &anomaly.ReviewedAt, &anomaly.ReviewedBy)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		anomalies = append(anomalies, anomaly)
+	}
+
+	return c.JSON(fiber.Map{"anomalies": anomalies})
+}
+
+/**
+ * ReviewProgressionAnomaly marks a flagged sync as reviewed (admin only)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func ReviewProgressionAnomaly(c *fiber.Ctx, db *sql.DB) error {
+	adminId := c.Locals("userId").(string)
+
+	result, err := db.Exec(`
+		UPDATE progression_anomalies SET reviewedAt = CURRENT_TIMESTAMP, reviewedBy = ?
+		WHERE id = ? AND reviewedAt IS NULL
+	`, adminId, c.Params("id"))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrorResponse(c, 404, "Open anomaly not found")
+	}
+
+	return c.JSON(fiber.Map{"message": "Anomaly marked as reviewed"})
+}
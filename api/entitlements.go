@@ -0,0 +1,375 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"os"
+	"time"
+)
+
+/**
+ * GameEntitlement grants one user access to one game regardless of subscription tier
+ */
+type GameEntitlement struct {
+	Id        string `json:"id"`
+	UserId    string `json:"userId"`
+	GameId    string `json:"gameId"`
+	GameSlug  string `json:"gameSlug"`
+	Source    string `json:"source"`
+	Reference string `json:"reference,omitempty"`
+	GrantedBy string `json:"grantedBy,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	RevokedAt string `json:"revokedAt,omitempty"`
+	CreatedAt string `json:"createdAt"`
+}
+
+/**
+ * EntitlementGrantRequest is the admin payload for granting an entitlement
+ */
+type EntitlementGrantRequest struct {
+	UserId    string `json:"userId"`
+	GameSlug  string `json:"gameSlug"`
+	Source    string `json:"source"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+/**
+ * PurchaseWebhookRequest is sent by the payment provider when a one-off purchase settles or is refunded
+ */
+type PurchaseWebhookRequest struct {
+	Event      string `json:"event"`
+	PurchaseId string `json:"purchaseId"`
+	UserId     string `json:"userId"`
+	GameSlug   string `json:"gameSlug"`
+	ExpiresAt  string `json:"expiresAt"`
+}
+
+var entitlementSources = map[string]bool{"purchase": true, "grant": true, "beta": true, "promo": true}
+
+const entitlementColumns = `e.id, e.userId, e.gameId, g.slug, e.source, e.reference, e.grantedBy, e.expiresAt, e.revokedAt, e.createdAt`
+
+/**
+ * HasGameAccess decides whether a user may access a game
+ * Access comes from the subscription tier or from an active per-game entitlement
+ * @param {*sql.DB} db - Database connection
+ * @param {string} userId - User ID (empty for anonymous requests)
+ * @param {Game} game - Game to check (Id and TierRequired must be set)
+ * @returns {bool, error} - Whether access is granted and error if any
+ */
+func HasGameAccess(db *sql.DB, userId string, game Game) (bool, error) {
+	return hasGameAccessForTier(db, userId, GetUserTier(db, userId), game)
+}
+
+// hasGameAccessForTier lets catalog listings resolve the user's tier once instead of per game
+func hasGameAccessForTier(db *sql.DB, userId string, userTier string, game Game) (bool, error) {
+	if CanAccessTier(userTier, game.TierRequired) {
+		return true, nil
+	}
+	if userId == "" {
+		return false, nil
+	}
+
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM game_entitlements
+		WHERE userId = ? AND gameId = ? AND revokedAt IS NULL
+		AND (expiresAt IS NULL OR expiresAt > CURRENT_TIMESTAMP)
+	`, userId, game.Id).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+/**
+ * CheckGamePlayable applies the subscription, entitlement and parental checks (content,
+ * daily minutes and allowed hours) shared by everything that hands out a game's files
+ * @param {*sql.DB} db - Database connection
+ * @param {string} userId - User ID (empty for anonymous requests)
+ * @param {Game} game - Game to check (Id, Slug, TierRequired and Rating must be set)
+ * @returns {error} - A 403 fiber error when refused, or a database error
+ */
+func CheckGamePlayable(db *sql.DB, userId string, game Game) error {
+	hasAccess, err := HasGameAccess(db, userId, game)
+	if err != nil {
+		return err
+	}
+	if !hasAccess {
+		return fiber.NewError(fiber.StatusForbidden, "Subscription tier required: "+game.TierRequired)
+	}
+
+	controls, err := GetParentalControls(db, userId)
+	if err != nil {
+		return err
+	}
+	if allowed, reason := CheckParentalGameAccess(controls, game); !allowed {
+		return fiber.NewError(fiber.StatusForbidden, reason)
+	}
+	if controls == nil {
+		return nil
+	}
+
+	// Daily minutes and allowed hours are enforced here too, so skipping heartbeats does not get around them
+	status, err := GetPlayTimeStatus(db, userId, controls, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if !status.Allowed {
+		return fiber.NewError(fiber.StatusForbidden, status.Reason)
+	}
+	return nil
+}
+
+/**
+ * GrantGameEntitlement stores a new entitlement
+ * @param {*sql.DB} db - Database connection
+ * @param {string} userId - User receiving access
+ * @param {string} gameSlug - Game slug
+ * @param {string} source - purchase, grant, beta or promo
+ * @param {string} reference - External reference such as a purchase id (optional)
+ * @param {string} grantedBy - Admin user id (optional)
+ * @param {string} expiresAt - RFC3339 expiry (optional)
+ * @returns {GameEntitlement, error} - Created entitlement and error if any
+ */
+func GrantGameEntitlement(db *sql.DB, userId string, gameSlug string, source string, reference string, grantedBy string, expiresAt string) (GameEntitlement, error) {
+	var expires interface{}
+	if expiresAt != "" {
+		parsed, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return GameEntitlement{}, fiber.NewError(fiber.StatusBadRequest, "expiresAt must be RFC3339")
+		}
+		expires = parsed.UTC()
+	}
+
+	var gameId string
+	err := db.QueryRow("SELECT id FROM games WHERE slug = ?", gameSlug).Scan(&gameId)
+	if err == sql.ErrNoRows {
+		return GameEntitlement{}, fiber.NewError(fiber.StatusNotFound, "Game not found")
+	}
+	if err != nil {
+		return GameEntitlement{}, err
+	}
+
+	var exists int
+	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ? AND isDeleted=0", userId).Scan(&exists)
+	if err != nil {
+		return GameEntitlement{}, err
+	}
+	if exists == 0 {
+		return GameEntitlement{}, fiber.NewError(fiber.StatusNotFound, "User not found")
+	}
+
+	id := uuid.New().String()
+	_, err = db.Exec(`
+		INSERT INTO game_entitlements(id, userId, gameId, source, reference, grantedBy, expiresAt)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, id, userId, gameId, source, nullIfEmpty(reference), nullIfEmpty(grantedBy), expires)
+	if err != nil {
+		return GameEntitlement{}, err
+	}
+
+	return getEntitlement(db, "e.id = ?", id)
+}
+
+func getEntitlement(db *sql.DB, where string, arg string) (GameEntitlement, error) {
+	row := db.QueryRow(`
+		SELECT `+entitlementColumns+`
+		FROM game_entitlements e JOIN games g ON g.id = e.gameId
+		WHERE `+where, arg)
+	return scanEntitlement(row)
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEntitlement(row rowScanner) (GameEntitlement, error) {
+	var entitlement GameEntitlement
+	var reference, grantedBy, expiresAt, revokedAt sql.NullString
+	err := row.Scan(&entitlement.Id, &entitlement.UserId, &entitlement.GameId, &entitlement.GameSlug, &entitlement.Source, &reference, &grantedBy, &expiresAt, &revokedAt, &entitlement.CreatedAt)
+	if err != nil {
+		return GameEntitlement{}, err
+	}
+	entitlement.Reference = reference.String
+	entitlement.GrantedBy = grantedBy.String
+	entitlement.ExpiresAt = expiresAt.String
+	entitlement.RevokedAt = revokedAt.String
+	return entitlement, nil
+}
+
+func listEntitlements(c *fiber.Ctx, db *sql.DB, userId string) error {
+	rows, err := db.Query(`
+		SELECT `+entitlementColumns+`
+		FROM game_entitlements e JOIN games g ON g.id = e.gameId
+		WHERE e.userId = ?
+		ORDER BY e.createdAt DESC
+	`, userId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer rows.Close()
+
+	entitlements := []GameEntitlement{}
+	for rows.Next() {
+		entitlement, err := scanEntitlement(rows)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		entitlements = append(entitlements, entitlement)
+	}
+
+	return c.JSON(fiber.Map{"entitlements": entitlements})
+}
+
+/**
+ * GetMyEntitlements lists the current user's entitlements
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetMyEntitlements(c *fiber.Ctx, db *sql.DB) error {
+	return listEntitlements(c, db, c.Locals("userId").(string))
+}
+
+/**
+ * GetUserEntitlements lists a user's entitlements (admin only)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetUserEntitlements(c *fiber.Ctx, db *sql.DB) error {
+	return listEntitlements(c, db, c.Params("id"))
+}
+
+/**
+ * GrantEntitlement grants a user access to a single game (admin only)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GrantEntitlement(c *fiber.Ctx, db *sql.DB) error {
+	adminId := c.Locals("userId").(string)
+
+	var grantReq EntitlementGrantRequest
+	if err := c.BodyParser(&grantReq); err != nil {
+		return ErrorResponse(c, 400, "Invalid request body")
+	}
+	if grantReq.UserId == "" || grantReq.GameSlug == "" {
+		return ErrorResponse(c, 400, "userId and gameSlug are required")
+	}
+	if grantReq.Source == "" {
+		grantReq.Source = "grant"
+	}
+	if !entitlementSources[grantReq.Source] {
+		return ErrorResponse(c, 400, "Invalid source")
+	}
+
+	entitlement, err := GrantGameEntitlement(db, grantReq.UserId, grantReq.GameSlug, grantReq.Source, "", adminId, grantReq.ExpiresAt)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Failed to grant entitlement")
+	}
+
+	return c.Status(201).JSON(entitlement)
+}
+
+/**
+ * RevokeEntitlement revokes an entitlement (admin only)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func RevokeEntitlement(c *fiber.Ctx, db *sql.DB) error {
+	id := c.Params("id")
+
+	result, err := db.Exec(`UPDATE game_entitlements SET revokedAt = CURRENT_TIMESTAMP WHERE id = ? AND revokedAt IS NULL`, id)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrorResponse(c, 404, "Active entitlement not found")
+	}
+
+	entitlement, err := getEntitlement(db, "e.id = ?", id)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	return c.JSON(entitlement)
+}
+
+/**
+ * PurchaseWebhook records one-off game purchases and refunds from the payment provider
+ * The body must be signed with PURCHASE_WEBHOOK_SECRET (hex HMAC-SHA256 in X-Webhook-Signature)
+ * Repeated deliveries of the same purchaseId are acknowledged without granting twice
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func PurchaseWebhook(c *fiber.Ctx, db *sql.DB) error {
+	secret := os.Getenv("PURCHASE_WEBHOOK_SECRET")
+	if secret == "" {
+		return ErrorResponse(c, 503, "Purchases are not configured")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(c.Body())
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(c.Get("X-Webhook-Signature"))) {
+		return ErrorResponse(c, 401, "Invalid signature")
+	}
+
+	var purchase PurchaseWebhookRequest
+	if err := json.Unmarshal(c.Body(), &purchase); err != nil {
+		return ErrorResponse(c, 400, "Invalid request body")
+	}
+	if purchase.PurchaseId == "" {
+		return ErrorResponse(c, 400, "purchaseId is required")
+	}
+
+	existing, err := getEntitlement(db, "e.reference = ?", purchase.PurchaseId)
+	if err != nil && err != sql.ErrNoRows {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	found := err == nil
+
+	switch purchase.Event {
+	case "purchase":
+		if found {
+			return c.JSON(existing)
+		}
+		if purchase.UserId == "" || purchase.GameSlug == "" {
+			return ErrorResponse(c, 400, "userId and gameSlug are required")
+		}
+		entitlement, err := GrantGameEntitlement(db, purchase.UserId, purchase.GameSlug, "purchase", purchase.PurchaseId, "", purchase.ExpiresAt)
+		if err != nil {
+			return FiberErrorResponse(c, err, "Failed to grant entitlement")
+		}
+		return c.Status(201).JSON(entitlement)
+	case "refund":
+		if !found {
+			return ErrorResponse(c, 404, "Purchase not found")
+		}
+		_, err := db.Exec(`UPDATE game_entitlements SET revokedAt = CURRENT_TIMESTAMP WHERE id = ? AND revokedAt IS NULL`, existing.Id)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		revoked, err := getEntitlement(db, "e.id = ?", existing.Id)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		return c.JSON(revoked)
+	default:
+		return ErrorResponse(c, 400, "event must be purchase or refund")
+	}
+}
+
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
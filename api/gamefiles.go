@@ -0,0 +1,344 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+/**
+ * ServeGameFile serves a file from the games directory once the requester may play the game
+ * Free games stay public; everything else needs a signed URL from the manifest endpoint,
+ * which is checked without touching the database, or an access token read from the
+ * Authorization header, the token cookie or a token query parameter
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func ServeGameFile(c *fiber.Ctx, db *sql.DB) error {
+	relative, err := url.PathUnescape(c.Params("*"))
+	if err != nil {
+		return ErrorResponse(c, 400, "Invalid path")
+	}
+	relative = strings.TrimPrefix(path.Clean("/"+relative), "/")
+
+	slug, _, _ := strings.Cut(relative, "/")
+	if !ValidateSlug(slug) {
+		return ErrorResponse(c, 404, "File not found")
+	}
+
+	if c.Query("sig") != "" {
+		if !verifySignedAssetUrl(c, relative) {
+			return ErrorResponse(c, 403, "Invalid or expired signature")
+		}
+		return sendGameFile(c, relative, true)
+	}
+
+	var game Game
+	err = db.QueryRow(`
+		SELECT id, slug, name, tierRequired, rating FROM games
+		WHERE slug = ? AND retiredAt IS NULL
+	`, slug).Scan(&game.Id, &game.Slug, &game.Name, &game.TierRequired, &game.Rating)
+	if err == sql.ErrNoRows {
+		return ErrorResponse(c, 404, "Game not found")
+	}
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	userId := gameFileUserId(c)
+	if err := CheckGamePlayable(db, userId, game); err != nil {
+		if fiberErr, ok := err.(*fiber.Error); ok && userId == "" {
+			return ErrorResponse(c, fiber.StatusUnauthorized, fiberErr.Message)
+		}
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	return sendGameFile(c, relative, game.TierRequired != "free")
+}
+
+/**
+ * sendGameFile serves one file with validators, byte ranges and precompressed siblings
+ * Files inside a release directory never change once uploaded, so they are cached
+ * for a year; files of legacy unversioned packages are revalidated on every use
+ */
+func sendGameFile(c *fiber.Ctx, relative string, gated bool) error {
+	filePath := filepath.Join(GamesDir, filepath.FromSlash(relative))
+	info, err := os.Stat(filePath)
+	if err == nil && info.IsDir() {
+		filePath = filepath.Join(filePath, "index.html")
+		info, err = os.Stat(filePath)
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		return ErrorResponse(c, 404, "File not found")
+	}
+
+	// Gated files depend on who asked, so shared caches must not keep them
+	cacheControl := "public"
+	if gated {
+		cacheControl = "private"
+	}
+	if isReleaseFile(relative) {
+		cacheControl += ", max-age=31536000, immutable"
+	} else {
+		cacheControl += ", no-cache"
+	}
+	c.Set("Cache-Control", cacheControl)
+	c.Set("Content-Type", assetMimeType(filePath))
+	c.Vary(fiber.HeaderAcceptEncoding)
+
+	suffix := ""
+	for _, encoding := range precompressedEncodings {
+		if !acceptsEncoding(c.Get(fiber.HeaderAcceptEncoding), encoding.Encoding) {
+			continue
+		}
+		// A sibling older than the file itself is stale and would serve old content
+		if sibling, err := os.Stat(filePath + encoding.Suffix); err == nil && sibling.Mode().IsRegular() && !sibling.ModTime().Before(info.ModTime()) {
+			c.Set(fiber.HeaderContentEncoding, encoding.Encoding)
+			filePath, info, suffix = filePath+encoding.Suffix, sibling, "-"+encoding.Encoding
+			break
+		}
+	}
+
+	etag := fmt.Sprintf(`"%x-%x%s"`, info.ModTime().UnixNano(), info.Size(), suffix)
+	lastModified := info.ModTime().UTC().Truncate(time.Second)
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, lastModified.Format(http.TimeFormat))
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+	if notModified(c, etag, lastModified) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	size := info.Size()
+	start, length := int64(0), size
+	if rangeHeader := c.Get(fiber.HeaderRange); rangeHeader != "" && ifRangeMatches(c.Get(fiber.HeaderIfRange), etag, lastModified) {
+		var satisfiable bool
+		start, length, satisfiable = parseByteRange(rangeHeader, size)
+		if !satisfiable {
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+			return c.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+		}
+		if length != size {
+			c.Status(fiber.StatusPartialContent)
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		}
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ErrorResponse(c, 404, "File not found")
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		file.Close()
+		return StandardErrorResponse(c, 500, "Could not read file", err)
+	}
+	// fasthttp closes the stream once the response is written
+	c.Response().SetBodyStream(struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, int(length))
+	return nil
+}
+
+/**
+ * isReleaseFile reports whether a path under the games directory lies inside a
+ * games/<slug>/<version>/ release directory
+ */
+func isReleaseFile(relative string) bool {
+	segments := strings.SplitN(relative, "/", 3)
+	if len(segments) < 3 || !ValidateVersion(segments[1]) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(GamesDir, segments[0], segments[1], "manifest.json"))
+	return err == nil
+}
+
+func acceptsEncoding(acceptEncoding string, encoding string) bool {
+	for _, candidate := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(candidate), ";")
+		if strings.EqualFold(strings.TrimSpace(name), encoding) {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+/**
+ * notModified evaluates If-None-Match, falling back to If-Modified-Since only when
+ * the client sent no entity tags
+ */
+func notModified(c *fiber.Ctx, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := c.Get(fiber.HeaderIfNoneMatch); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag)
+	}
+	if since, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince)); err == nil {
+		return !lastModified.After(since)
+	}
+	return false
+}
+
+// ifRangeMatches lets a resumed download continue only if the file is unchanged
+func ifRangeMatches(ifRange string, etag string, lastModified time.Time) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == etag
+	}
+	since, err := http.ParseTime(ifRange)
+	return err == nil && since.Equal(lastModified)
+}
+
+/**
+ * parseByteRange reads a single "bytes=" range
+ * Malformed or multi-part ranges fall back to the whole file, as HTTP allows
+ * @returns {int64} First byte to send
+ * @returns {int64} Number of bytes to send
+ * @returns {bool} False if the range starts beyond the end of the file
+ */
+func parseByteRange(rangeHeader string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(rangeHeader, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, true
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size, true
+	}
+
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, size, true
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, false
+		}
+		suffix = min(suffix, size)
+		return size - suffix, suffix, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, true
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, size, true
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true
+}
+
+/**
+ * gameFileUserId identifies the requester of a game file
+ * Pages loaded into the player iframe only carry the cookie, and URLs handed to
+ * other code can carry the token in the query string
+ */
+func gameFileUserId(c *fiber.Ctx) string {
+	if userId := GetOptionalUserId(c); userId != "" {
+		return userId
+	}
+	if token := c.Cookies("token"); token != "" {
+		if userId := userIdFromToken(token); userId != "" {
+			return userId
+		}
+	}
+	if token := c.Query("token"); token != "" {
+		return userIdFromToken(token)
+	}
+	return ""
+}
+
+/**
+ * GetAssetUrlExpiration returns how long signed game asset URLs stay valid
+ * Defaults to 1 hour if not set
+ */
+func GetAssetUrlExpiration() time.Duration {
+	expStr := os.Getenv("GAME_ASSET_URL_EXPIRATION")
+	if expStr == "" {
+		return time.Hour
+	}
+	if duration, err := time.ParseDuration(expStr); err == nil {
+		return duration
+	}
+	return time.Hour
+}
+
+// gameNeedsSignedUrls reports whether a game's files are gated and so handed out as signed URLs
+func gameNeedsSignedUrls(game Game) bool {
+	return game.TierRequired != "free"
+}
+
+/**
+ * SignedAssetQuery signs a release directory for one user until the expiry
+ * The scope is the release's baseUrl, which names both the slug and the version,
+ * so one query string covers every file of the release
+ * @param {string} userId - User the access check was done for
+ * @param {string} baseUrl - Release base URL, such as /games/<slug>/<version>/
+ * @returns {string} Query string, including the leading "?", to append to asset URLs
+ * @returns {time.Time} When the signature expires
+ */
+func SignedAssetQuery(userId string, baseUrl string) (string, time.Time) {
+	expiresAt := time.Now().UTC().Add(GetAssetUrlExpiration()).Truncate(time.Second)
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	query := url.Values{
+		"uid": {userId},
+		"exp": {expires},
+		"sig": {signAssetScope(userId, baseUrl, expires)},
+	}
+	return "?" + query.Encode(), expiresAt
+}
+
+func signAssetScope(userId string, baseUrl string, expires string) string {
+	// Derive a separate key so asset signatures can never pass as JWTs or vice versa
+	keyMac := hmac.New(sha256.New, SecretKey)
+	keyMac.Write([]byte("game-assets"))
+
+	mac := hmac.New(sha256.New, keyMac.Sum(nil))
+	mac.Write([]byte(userId + "\n" + baseUrl + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/**
+ * verifySignedAssetUrl checks a signed asset URL against the release directories the
+ * requested file could belong to: /games/<slug>/<version>/, or /games/<slug>/ for
+ * releases stored directly in the game directory
+ */
+func verifySignedAssetUrl(c *fiber.Ctx, relative string) bool {
+	expires := c.Query("exp")
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().UTC().Unix() > expiresAt {
+		return false
+	}
+
+	signature := []byte(c.Query("sig"))
+	segments := strings.Split(relative, "/")
+	for depth := min(2, len(segments)-1); depth >= 1; depth-- {
+		scope := "/games/" + strings.Join(segments[:depth], "/") + "/"
+		if hmac.Equal(signature, []byte(signAssetScope(c.Query("uid"), scope, expires))) {
+			return true
+		}
+	}
+	return false
+}
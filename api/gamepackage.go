@@ -0,0 +1,229 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// PackageFormat identifies the layout of GET /games/:slug/package responses
+const PackageFormat = "celestial-package-1"
+
+/**
+ * GamePackageIndex is the index at the start of a package download
+ * Offsets are relative to the first byte after the index
+ */
+type GamePackageIndex struct {
+	Format      string         `json:"format"`
+	Version     string         `json:"version"`
+	EntryPoint  string         `json:"entryPoint"`
+	BaseUrl     string         `json:"baseUrl"`
+	ContentHash string         `json:"contentHash"`
+	TotalSize   int64          `json:"totalSize"`
+	Assets      []PackageEntry `json:"assets"`
+}
+
+/**
+ * PackageEntry is one asset of a package and where its bytes start
+ */
+type PackageEntry struct {
+	ManifestAsset
+	Offset int64 `json:"offset"`
+}
+
+/**
+ * packageSegment is either an in-memory header or a file on disk
+ */
+type packageSegment struct {
+	data []byte
+	path string
+	size int64
+}
+
+/**
+ * GetGamePackage streams the live release as a single file: a 4-byte big-endian
+ * index length, the JSON index, then every asset's bytes back to back
+ * The layout only depends on the release, so interrupted downloads resume with Range
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetGamePackage(c *fiber.Ctx, db *sql.DB) error {
+	game, _, storedManifest, err := findPlayableGame(db, c.Params("slug"), GetOptionalUserId(c))
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	manifest, err := loadManifestV2(game.ManifestPath, storedManifest)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Could not load manifest")
+	}
+
+	segments, err := buildPackageSegments(game, manifest)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Could not build package")
+	}
+
+	var size int64
+	for _, segment := range segments {
+		size += segment.size
+	}
+
+	etag := `"` + manifest.ContentHash + `-package"`
+	c.Set("Cache-Control", "private, no-cache")
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	c.Set(fiber.HeaderContentType, "application/octet-stream")
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	start, length := int64(0), size
+	if rangeHeader := c.Get(fiber.HeaderRange); rangeHeader != "" && ifRangeMatches(c.Get(fiber.HeaderIfRange), etag, time.Time{}) {
+		var satisfiable bool
+		start, length, satisfiable = parseByteRange(rangeHeader, size)
+		if !satisfiable {
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+			return c.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+		}
+		if length != size {
+			c.Status(fiber.StatusPartialContent)
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		}
+	}
+
+	c.Response().SetBodyStream(&packageReader{segments: segments, skip: start, remaining: length}, int(length))
+	return nil
+}
+
+/**
+ * buildPackageSegments lays out the package, checking every asset still has the
+ * size the manifest records; a changed file would shift every offset after it
+ */
+func buildPackageSegments(game Game, manifest *GameManifestV2) ([]packageSegment, error) {
+	resolvedPath, _, _ := ResolveManifestPath(game.ManifestPath)
+	releaseDir := filepath.Dir(resolvedPath)
+
+	index := GamePackageIndex{
+		Format:      PackageFormat,
+		Version:     manifest.Version,
+		EntryPoint:  manifest.EntryPoint,
+		BaseUrl:     manifest.BaseUrl,
+		ContentHash: manifest.ContentHash,
+		TotalSize:   manifest.TotalSize,
+		Assets:      []PackageEntry{},
+	}
+	files := []packageSegment{}
+	var offset int64
+	for _, asset := range manifest.Assets {
+		assetPath, ok := resolveAssetPath(releaseDir, asset.Path)
+		if !ok {
+			return nil, fiber.NewError(fiber.StatusInternalServerError, "Invalid asset path: "+asset.Path)
+		}
+		info, err := os.Stat(assetPath)
+		if err != nil || info.Size() != asset.Size {
+			log.Printf("Release %s asset %s is missing or changed on disk", game.ManifestPath, asset.Path)
+			return nil, fiber.NewError(fiber.StatusInternalServerError, "Game release files changed on disk: "+asset.Path)
+		}
+		index.Assets = append(index.Assets, PackageEntry{ManifestAsset: asset, Offset: offset})
+		files = append(files, packageSegment{path: assetPath, size: asset.Size})
+		offset += asset.Size
+	}
+
+	indexJson, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(indexJson)))
+	header = append(header, indexJson...)
+	return append([]packageSegment{{data: header, size: int64(len(header))}}, files...), nil
+}
+
+/**
+ * packageReader reads a byte range across the package segments, opening each
+ * file only when the range reaches it
+ */
+type packageReader struct {
+	segments  []packageSegment
+	skip      int64
+	remaining int64
+	current   io.Reader
+	file      *os.File
+}
+
+func (reader *packageReader) Read(p []byte) (int, error) {
+	for reader.remaining > 0 {
+		if reader.current == nil {
+			if len(reader.segments) == 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			segment := reader.segments[0]
+			reader.segments = reader.segments[1:]
+			if reader.skip >= segment.size {
+				reader.skip -= segment.size
+				continue
+			}
+			if err := reader.open(segment); err != nil {
+				return 0, err
+			}
+		}
+
+		if int64(len(p)) > reader.remaining {
+			p = p[:reader.remaining]
+		}
+		n, err := reader.current.Read(p)
+		reader.remaining -= int64(n)
+		if err == io.EOF {
+			reader.closeFile()
+			reader.current = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+func (reader *packageReader) open(segment packageSegment) error {
+	if segment.data != nil {
+		reader.current = bytes.NewReader(segment.data[reader.skip:])
+		reader.skip = 0
+		return nil
+	}
+
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(reader.skip, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	reader.file = file
+	reader.current = io.LimitReader(file, segment.size-reader.skip)
+	reader.skip = 0
+	return nil
+}
+
+func (reader *packageReader) closeFile() {
+	if reader.file != nil {
+		reader.file.Close()
+		reader.file = nil
+	}
+}
+
+// Close is called by fasthttp once the response has been written
+func (reader *packageReader) Close() error {
+	reader.closeFile()
+	return nil
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Games keep small save-like values in their state blob; anything larger belongs elsewhere
+const maxGameStateBytes = 16 * 1024
+
+/**
+ * GameProgression is a user's progression within one game
+ * Coins stay global; XP here is the part of the global XP earned in this game
+ * State is a JSON object the game can use for its own key/value data
+ */
+type GameProgression struct {
+	GameSlug      string          `json:"gameSlug"`
+	Xp            int             `json:"xp"`
+	Achievements  []string        `json:"achievements"`
+	UnlockedItems []string        `json:"unlockedItems"`
+	State         json.RawMessage `json:"state"`
+	UpdatedAt     string          `json:"updatedAt,omitempty"`
+}
+
+/**
+ * validateGameState checks that a sync's state blob is a JSON object within the size limit
+ * @param {json.RawMessage} state - State sent by the client, or empty to leave it unchanged
+ * @returns {bool} True if the state can be stored
+ */
+func validateGameState(state json.RawMessage) bool {
+	if len(state) == 0 {
+		return true
+	}
+	if len(state) > maxGameStateBytes {
+		return false
+	}
+	var object map[string]json.RawMessage
+	return json.Unmarshal(state, &object) == nil && object != nil
+}
+
+/**
+ * loadGameProgression reads a user's progression in one game, empty if they have none yet
+ * @param {queryer} db - Database connection or transaction
+ * @param {string} userId - User ID
+ * @param {string} gameSlug - Game slug
+ * @returns {GameProgression, error} Progression and error if any
+ */
+func loadGameProgression(db queryer, userId string, gameSlug string) (GameProgression, error) {
+	progression := GameProgression{GameSlug: gameSlug, Achievements: []string{}, UnlockedItems: []string{}, State: json.RawMessage("{}")}
+
+	var achievementsJSON, unlockedItemsJSON, state string
+	err := db.QueryRow(`
+		SELECT xp, achievements, unlockedItems, state, updatedAt FROM game_progression
+		WHERE userId = ? AND gameSlug = ?
+	`, userId, gameSlug).Scan(&progression.Xp, &achievementsJSON, &unlockedItemsJSON, &state, &progression.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return progression, nil
+	}
+	if err != nil {
+		return progression, err
+	}
+
+	json.Unmarshal([]byte(achievementsJSON), &progression.Achievements)
+	json.Unmarshal([]byte(unlockedItemsJSON), &progression.UnlockedItems)
+	if progression.Achievements == nil {
+		progression.Achievements = []string{}
+	}
+	if progression.UnlockedItems == nil {
+		progression.UnlockedItems = []string{}
+	}
+	progression.State = json.RawMessage(state)
+	return progression, nil
+}
+
+/**
+ * applyGameProgression adds a sync's awarded XP, achievements, items and state to
+ * the originating game's progression
+ * @param {queryer} db - The sync's transaction
+ * @param {string} userId - User ID
+ * @param {ProgressionSyncRequest} syncReq - Request naming the game
+ * @param {int} xp - XP the sync awarded, including achievement rewards
+ * @returns {GameProgression, error} Updated progression and error if any
+ */
+func applyGameProgression(db queryer, userId string, syncReq ProgressionSyncRequest, xp int) (GameProgression, error) {
+	progression, err := loadGameProgression(db, userId, syncReq.GameSlug)
+	if err != nil {
+		return progression, err
+	}
+
+	progression.Xp += xp
+	progression.Achievements = mergeUniqueStrings(progression.Achievements, syncReq.NewAchievements)
+	progression.UnlockedItems = mergeUniqueStrings(progression.UnlockedItems, syncReq.NewUnlockedItems)
+	if len(syncReq.State) > 0 {
+		// Compact so the stored blob does not count the client's whitespace
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, syncReq.State); err == nil {
+			progression.State = compacted.Bytes()
+		}
+	}
+
+	achievementsJSON, _ := json.Marshal(progression.Achievements)
+	unlockedItemsJSON, _ := json.Marshal(progression.UnlockedItems)
+	err = db.QueryRow(`
+		INSERT INTO game_progression(userId, gameSlug, xp, achievements, unlockedItems, state, updatedAt)
+		VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(userId, gameSlug) DO UPDATE SET
+			xp = excluded.xp,
+			achievements = excluded.achievements,
+			unlockedItems = excluded.unlockedItems,
+			state = excluded.state,
+			updatedAt = excluded.updatedAt
+		RETURNING updatedAt
+	`, userId, syncReq.GameSlug, progression.Xp, string(achievementsJSON), string(unlockedItemsJSON), string(progression.State)).Scan(&progression.UpdatedAt)
+	return progression, err
+}
+
+/**
+ * GetGameProgression returns the current user's progression in one game
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetGameProgression(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+
+	if _, err := findGameId(db, c.Params("slug")); err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	progression, err := loadGameProgression(db, userId, c.Params("slug"))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	return c.JSON(progression)
+}
@@ -6,20 +6,30 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
 	"os"
-	"path/filepath"
 )
 
 type Game struct {
-	Id           string `json:"id"`
-	Slug         string `json:"slug"`
-	Name         string `json:"name"`
-	Description  string `json:"description,omitempty"`
-	Version      string `json:"version"`
-	TierRequired string `json:"tierRequired"`
-	ManifestPath string `json:"manifestPath"`
-	SizeBytes    int64  `json:"sizeBytes"`
-	CreatedAt    string `json:"createdAt,omitempty"`
-	UpdatedAt    string `json:"updatedAt,omitempty"`
+	Id           string      `json:"id"`
+	Slug         string      `json:"slug"`
+	Name         string      `json:"name"`
+	Description  string      `json:"description,omitempty"`
+	Version      string      `json:"version"`
+	TierRequired string      `json:"tierRequired"`
+	ManifestPath string      `json:"manifestPath"`
+	SizeBytes    int64       `json:"sizeBytes"`
+	Rating       string      `json:"rating"`
+	Categories   []string    `json:"categories,omitempty"`
+	Tags         []string    `json:"tags,omitempty"`
+	CreatedAt    string      `json:"createdAt,omitempty"`
+	UpdatedAt    string      `json:"updatedAt,omitempty"`
+	Access       *GameAccess `json:"access,omitempty"`
+}
+
+type GameAccess struct {
+	Granted        bool     `json:"granted"`
+	RequiredTier   string   `json:"requiredTier"`
+	Reason         string   `json:"reason,omitempty"`
+	UpgradeOptions []string `json:"upgradeOptions,omitempty"`
 }
 
 type Subscription struct {
@@ -32,12 +42,54 @@ type Subscription struct {
 	CreatedAt string `json:"createdAt"`
 }
 
+/**
+ * GameManifest is a game's manifest.json; see ParseGameManifest for the rules
+ * The launcher fields from orientation on are optional
+ */
 type GameManifest struct {
-	Version     string   `json:"version"`
-	EntryPoint  string   `json:"entryPoint"`
-	Assets      []string `json:"assets"`
-	TotalSize   int64    `json:"totalSize"`
-	LastUpdated string   `json:"lastUpdated"`
+	ManifestVersion  int                   `json:"manifestVersion,omitempty"`
+	Version          string                `json:"version"`
+	EntryPoint       string                `json:"entryPoint"`
+	Assets           []string              `json:"assets"`
+	TotalSize        int64                 `json:"totalSize"`
+	LastUpdated      string                `json:"lastUpdated"`
+	MinEngineVersion string                `json:"minEngineVersion,omitempty"`
+	Orientation      string                `json:"orientation,omitempty"`
+	InputMethods     []string              `json:"inputMethods,omitempty"`
+	RequiredFeatures []string              `json:"requiredFeatures,omitempty"`
+	ContentRating    string                `json:"contentRating,omitempty"`
+	Thumbnail        string                `json:"thumbnail,omitempty"`
+	Screenshots      []string              `json:"screenshots,omitempty"`
+	Progression      []string              `json:"progression,omitempty"`
+	EarningLimits    *EarningLimits        `json:"earningLimits,omitempty"`
+	Achievements     []ManifestAchievement `json:"achievements,omitempty"`
+	// URL the entry point and assets are served under, filled in from the live release
+	BaseUrl string `json:"baseUrl,omitempty"`
+}
+
+/**
+ * readGameManifest loads the manifest of a game's live release from games.manifestPath
+ * @param {Game} game - Game with ManifestPath set
+ * @returns {*GameManifest} Manifest with BaseUrl filled in
+ * @returns {error} A *fiber.Error describing why the manifest could not be read
+ */
+func readGameManifest(game Game) (*GameManifest, error) {
+	manifestPath, baseUrl, ok := ResolveManifestPath(game.ManifestPath)
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Manifest file not found")
+	}
+
+	manifestData, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Manifest file not found")
+	}
+
+	var manifest GameManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Invalid manifest format")
+	}
+	manifest.BaseUrl = baseUrl
+	return &manifest, nil
 }
 
 func GetOptionalUserId(c *fiber.Ctx) string {
@@ -45,10 +97,20 @@ func GetOptionalUserId(c *fiber.Ctx) string {
 	if authHeader == "" {
 		return ""
 	}
-	tokenString := authHeader
+	return userIdFromToken(bearerToken(authHeader))
+}
+
+// bearerToken strips the optional "Bearer " prefix from an Authorization header
+func bearerToken(authHeader string) string {
 	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-		tokenString = authHeader[7:]
+		return authHeader[7:]
 	}
+	return authHeader
+}
+
+// userIdFromToken returns the user a valid access token belongs to, or "" for any other token
+// Every route that authenticates a user goes through it, so refresh tokens are refused everywhere
+func userIdFromToken(tokenString string) string {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fiber.ErrUnauthorized
@@ -58,10 +120,16 @@ func GetOptionalUserId(c *fiber.Ctx) string {
 	if err != nil || !token.Valid {
 		return ""
 	}
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		if userId, ok := claims["id"].(string); ok {
-			return userId
-		}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	// Refresh tokens are also signed with SecretKey but must only be accepted by /api/refresh
+	if tokenType, ok := claims["type"].(string); !ok || tokenType != "access" {
+		return ""
+	}
+	if userId, ok := claims["id"].(string); ok {
+		return userId
 	}
 	return ""
 }
@@ -83,6 +151,8 @@ func GetUserTier(db *sql.DB, userId string) string {
 	return tier
 }
 
+var subscriptionTiers = []string{"free", "basic", "premium"}
+
 func CanAccessTier(userTier string, requiredTier string) bool {
 	tierHierarchy := map[string]int{"free": 0, "basic": 1, "premium": 2}
 	userLevel, userExists := tierHierarchy[userTier]
@@ -93,142 +163,116 @@ func CanAccessTier(userTier string, requiredTier string) bool {
 	return userLevel >= requiredLevel
 }
 
-func GetGamesPublic(c *fiber.Ctx, db *sql.DB) error {
-	userId := GetOptionalUserId(c)
-	userTier := GetUserTier(db, userId)
-
-	rows, err := db.Query(`
-		SELECT id, slug, name, description, version, tierRequired, manifestPath, sizeBytes, createdAt, updatedAt
-		FROM games
-		ORDER BY name ASC
-	`)
-	if err != nil {
-		return StandardErrorResponse(c, 500, "Database error", err)
+func buildGameAccess(userId string, granted bool, game Game) *GameAccess {
+	access := &GameAccess{Granted: granted, RequiredTier: game.TierRequired}
+	if granted {
+		return access
 	}
-	defer rows.Close()
-
-	var games []Game
-	for rows.Next() {
-		var game Game
-		err := rows.Scan(&game.Id, &game.Slug, &game.Name, &game.Description, &game.Version, &game.TierRequired, &game.ManifestPath, &game.SizeBytes, &game.CreatedAt, &game.UpdatedAt)
-		if err != nil {
-			return StandardErrorResponse(c, 500, "Database scan error", err)
-		}
-		if CanAccessTier(userTier, game.TierRequired) {
-			games = append(games, game)
-		}
+	if userId == "" {
+		access.Reason = "login_required"
+	} else {
+		access.Reason = "tier_required"
 	}
-
-	if games == nil {
-		games = []Game{}
+	for _, tier := range subscriptionTiers {
+		if CanAccessTier(tier, game.TierRequired) {
+			access.UpgradeOptions = append(access.UpgradeOptions, tier)
+		}
 	}
-
-	return c.JSON(fiber.Map{"games": games, "userTier": userTier, "isAuthenticated": userId != ""})
+	return access
 }
 
-func GetGames(c *fiber.Ctx, db *sql.DB) error {
-	userId := c.Locals("userId").(string)
+func GetGamesPublic(c *fiber.Ctx, db *sql.DB) error {
+	userId := GetOptionalUserId(c)
 	userTier := GetUserTier(db, userId)
 
-	rows, err := db.Query(`
-		SELECT id, slug, name, description, version, tierRequired, manifestPath, sizeBytes, createdAt, updatedAt
-		FROM games
-		ORDER BY name ASC
-	`)
+	query, err := ParseCatalogQuery(c, c.Query("collection"))
 	if err != nil {
-		return StandardErrorResponse(c, 500, "Database error", err)
+		return ErrorResponse(c, 400, err.Error())
+	}
+	if query.Favorites && userId == "" {
+		return ErrorResponse(c, 401, "Log in to see favorites")
 	}
-	defer rows.Close()
 
-	var games []Game
-	for rows.Next() {
-		var game Game
-		err := rows.Scan(&game.Id, &game.Slug, &game.Name, &game.Description, &game.Version, &game.TierRequired, &game.ManifestPath, &game.SizeBytes, &game.CreatedAt, &game.UpdatedAt)
-		if err != nil {
-			return StandardErrorResponse(c, 500, "Database scan error", err)
-		}
-		if CanAccessTier(userTier, game.TierRequired) {
-			games = append(games, game)
-		}
+	controls, err := GetParentalControls(db, userId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
 	}
 
-	if games == nil {
-		games = []Game{}
+	games, nextCursor, err := QueryCatalog(db, userId, userTier, controls, query)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
 	}
 
-	return c.JSON(fiber.Map{"games": games, "userTier": userTier})
+	return c.JSON(fiber.Map{"games": games, "userTier": userTier, "isAuthenticated": userId != "", "nextCursor": nextCursor})
 }
 
-func GetGameManifestPublic(c *fiber.Ctx, db *sql.DB) error {
-	slug := c.Params("slug")
-	userId := GetOptionalUserId(c)
-	userTier := GetUserTier(db, userId)
-
+/**
+ * findPlayableGame loads a catalog game with its live release's stored v2 manifest
+ * and applies the access checks every download endpoint shares
+ * @returns {Game} Game with Id, Slug, Name, TierRequired, ManifestPath and Rating set
+ * @returns {string} Live release content hash
+ * @returns {string} Stored v2 manifest JSON, empty for releases registered without one
+ * @returns {error} A fiber error for missing or refused games, or a database error
+ */
+func findPlayableGame(db *sql.DB, slug string, userId string) (Game, string, string, error) {
 	var game Game
+	var contentHash, storedManifest string
 	err := db.QueryRow(`
-		SELECT id, slug, name, tierRequired, manifestPath
-		FROM games
-		WHERE slug = ?
-	`, slug).Scan(&game.Id, &game.Slug, &game.Name, &game.TierRequired, &game.ManifestPath)
-
+		SELECT g.id, g.slug, g.name, g.tierRequired, g.manifestPath, g.rating, COALESCE(g.contentHash, ''), COALESCE(r.manifestJson, '')
+		FROM games g LEFT JOIN game_releases r ON r.id = g.liveReleaseId
+		WHERE g.slug = ? AND g.retiredAt IS NULL
+	`, slug).Scan(&game.Id, &game.Slug, &game.Name, &game.TierRequired, &game.ManifestPath, &game.Rating, &contentHash, &storedManifest)
 	if err == sql.ErrNoRows {
-		return ErrorResponse(c, 404, "Game not found")
-	}
-	if err != nil {
-		return StandardErrorResponse(c, 500, "Database error", err)
+		return game, "", "", fiber.NewError(fiber.StatusNotFound, "Game not found")
 	}
-
-	if !CanAccessTier(userTier, game.TierRequired) {
-		return ErrorResponse(c, 403, "Subscription tier required: "+game.TierRequired)
-	}
-
-	manifestPath := filepath.Join("games", slug, "manifest.json")
-	manifestData, err := os.ReadFile(manifestPath)
 	if err != nil {
-		return ErrorResponse(c, 404, "Manifest file not found")
+		return game, "", "", err
 	}
 
-	var manifest GameManifest
-	if err := json.Unmarshal(manifestData, &manifest); err != nil {
-		return ErrorResponse(c, 500, "Invalid manifest format")
+	if err := CheckGamePlayable(db, userId, game); err != nil {
+		return game, "", "", err
 	}
-
-	return c.JSON(manifest)
+	return game, contentHash, storedManifest, nil
 }
 
-func GetGameManifest(c *fiber.Ctx, db *sql.DB) error {
+func GetGameManifestPublic(c *fiber.Ctx, db *sql.DB) error {
 	slug := c.Params("slug")
-	userId := c.Locals("userId").(string)
-	userTier := GetUserTier(db, userId)
-
-	var game Game
-	err := db.QueryRow(`
-		SELECT id, slug, name, tierRequired, manifestPath
-		FROM games
-		WHERE slug = ?
-	`, slug).Scan(&game.Id, &game.Slug, &game.Name, &game.TierRequired, &game.ManifestPath)
+	userId := GetOptionalUserId(c)
 
-	if err == sql.ErrNoRows {
-		return ErrorResponse(c, 404, "Game not found")
+	schema := c.QueryInt("schema", 1)
+	if schema != 1 && schema != 2 {
+		return ErrorResponse(c, 400, "schema must be 1 or 2")
 	}
+
+	game, contentHash, storedManifest, err := findPlayableGame(db, slug, userId)
 	if err != nil {
-		return StandardErrorResponse(c, 500, "Database error", err)
+		return FiberErrorResponse(c, err, "Database error")
 	}
 
-	if !CanAccessTier(userTier, game.TierRequired) {
-		return ErrorResponse(c, 403, "Subscription tier required: "+game.TierRequired)
+	if from := c.Query("from"); from != "" {
+		return sendManifestDelta(c, db, game, userId, storedManifest, from)
 	}
 
-	manifestPath := filepath.Join("games", slug, "manifest.json")
-	manifestData, err := os.ReadFile(manifestPath)
-	if err != nil {
-		return ErrorResponse(c, 404, "Manifest file not found")
+	if schema == 2 {
+		manifest, err := loadManifestV2(game.ManifestPath, storedManifest)
+		if err != nil {
+			return FiberErrorResponse(c, err, "Could not load manifest")
+		}
+		if gameNeedsSignedUrls(game) {
+			signManifestUrls(manifest, userId)
+			return sendWithETag(c, "", manifest)
+		}
+		return sendWithETag(c, `"`+manifest.ContentHash+`-2"`, manifest)
 	}
 
-	var manifest GameManifest
-	if err := json.Unmarshal(manifestData, &manifest); err != nil {
-		return ErrorResponse(c, 500, "Invalid manifest format")
+	manifest, err := readGameManifest(game)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Manifest file not found")
 	}
 
-	return c.JSON(manifest)
+	etag := ""
+	if contentHash != "" {
+		etag = `"` + contentHash + `"`
+	}
+	return sendWithETag(c, etag, manifest)
 }
@@ -0,0 +1,372 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Slot names appear in URLs and are picked by games, e.g. "auto" or "slot-1"
+var saveSlotPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+const (
+	maxSaveSlots = 10
+	// Older revisions beyond this many are dropped on every write
+	saveRevisionsKept = 5
+)
+
+// Content types a save is served back with; anything else is stored as application/octet-stream
+var saveContentTypes = map[string]bool{"application/octet-stream": true, "application/json": true, "text/plain": true}
+
+// Largest save a user can store per slot, by subscription tier
+var saveSizeLimits = map[string]int{"free": 64 * 1024, "basic": 256 * 1024, "premium": 1024 * 1024}
+
+/**
+ * GameSave describes one revision of a save slot
+ * Data is only filled in for conflict responses; GET sends the save as the response body
+ */
+type GameSave struct {
+	Slot        string `json:"slot"`
+	Revision    int64  `json:"revision"`
+	SizeBytes   int    `json:"sizeBytes"`
+	ContentType string `json:"contentType"`
+	DeviceId    string `json:"deviceId,omitempty"`
+	UpdatedAt   string `json:"updatedAt"`
+	Data        []byte `json:"data,omitempty"`
+}
+
+// saveContentType reduces a Content-Type header to one of saveContentTypes
+func saveContentType(header string) string {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil || !saveContentTypes[mediaType] {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+func saveETag(revision int64) string {
+	return fmt.Sprintf(`"%d"`, revision)
+}
+
+/**
+ * loadGameSave reads a revision of a save slot, or its latest revision when revision is 0
+ * @param {queryer} db - Database connection or transaction
+ * @param {string} userId - User ID
+ * @param {string} gameSlug - Game slug
+ * @param {string} slot - Slot name
+ * @param {int64} revision - Revision to read, or 0 for the latest
+ * @returns {*GameSave, error} Save, or nil if there is none, and error if any
+ */
+func loadGameSave(db queryer, userId string, gameSlug string, slot string, revision int64) (*GameSave, error) {
+	query := `
+		SELECT slot, revision, sizeBytes, contentType, deviceId, createdAt, data FROM game_saves
+		WHERE userId = ? AND gameSlug = ? AND slot = ?`
+	args := []interface{}{userId, gameSlug, slot}
+	if revision > 0 {
+		query += " AND revision = ?"
+		args = append(args, revision)
+	}
+	query += " ORDER BY revision DESC LIMIT 1"
+
+	var save GameSave
+	err := db.QueryRow(query, args...).Scan(&save.Slot, &save.Revision, &save.SizeBytes, &save.ContentType, &save.DeviceId, &save.UpdatedAt, &save.Data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &save, nil
+}
+
+// saveSlotParams checks the slot named in the URL and that the user may play its game
+func saveSlotParams(c *fiber.Ctx, db *sql.DB) (string, string, error) {
+	gameSlug, slot := c.Params("slug"), c.Params("slot")
+	if _, _, _, err := findPlayableGame(db, gameSlug, c.Locals("userId").(string)); err != nil {
+		return "", "", err
+	}
+	if slot != "" && !saveSlotPattern.MatchString(slot) {
+		return "", "", fiber.NewError(fiber.StatusBadRequest, "Slot names must be 1-32 letters, digits, '_' or '-'")
+	}
+	return gameSlug, slot, nil
+}
+
+/**
+ * GetGameSaves lists the current user's save slots in a game, with their latest revisions
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetGameSaves(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+	gameSlug, _, err := saveSlotParams(c, db)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	rows, err := db.Query(`
+		SELECT slot, revision, sizeBytes, contentType, deviceId, createdAt FROM game_saves s
+		WHERE userId = ? AND gameSlug = ?
+		AND revision = (SELECT MAX(revision) FROM game_saves WHERE userId = s.userId AND gameSlug = s.gameSlug AND slot = s.slot)
+		ORDER BY slot
+	`, userId, gameSlug)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer rows.Close()
+
+	saves := []GameSave{}
+	for rows.Next() {
+		var save GameSave
+		if err := rows.Scan(&save.Slot, &save.Revision, &save.SizeBytes, &save.ContentType, &save.DeviceId, &save.UpdatedAt); err != nil {
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		saves = append(saves, save)
+	}
+
+	return c.JSON(fiber.Map{
+		"saves":        saves,
+		"maxSlots":     maxSaveSlots,
+		"maxSizeBytes": saveSizeLimits[GetUserTier(db, userId)],
+	})
+}
+
+/**
+ * GetGameSave sends a save slot's data as the response body, with its revision as the ETag
+ * Query params: revision (one of the kept older revisions instead of the latest)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetGameSave(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+	gameSlug, slot, err := saveSlotParams(c, db)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	revision := int64(c.QueryInt("revision", 0))
+	if revision < 0 {
+		return ErrorResponse(c, 400, "Invalid revision")
+	}
+	save, err := loadGameSave(db, userId, gameSlug, slot, revision)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if save == nil {
+		return ErrorResponse(c, 404, "Save not found")
+	}
+
+	etag := saveETag(save.Revision)
+	c.Set("Cache-Control", "no-cache")
+	c.Set("ETag", etag)
+	if etagMatches(c.Get("If-None-Match"), etag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	// Saves are whatever the game sent, so browsers must not sniff them into something renderable
+	c.Set("Content-Type", saveContentType(save.ContentType))
+	c.Set("X-Content-Type-Options", "nosniff")
+	return c.Send(save.Data)
+}
+
+/**
+ * GetGameSaveRevisions lists the kept revisions of a save slot, newest first
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetGameSaveRevisions(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+	gameSlug, slot, err := saveSlotParams(c, db)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	rows, err := db.Query(`
+		SELECT slot, revision, sizeBytes, contentType, deviceId, createdAt FROM game_saves
+		WHERE userId = ? AND gameSlug = ? AND slot = ?
+		ORDER BY revision DESC
+	`, userId, gameSlug, slot)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer rows.Close()
+
+	revisions := []GameSave{}
+	for rows.Next() {
+		var save GameSave
+		if err := rows.Scan(&save.Slot, &save.Revision, &save.SizeBytes, &save.ContentType, &save.DeviceId, &save.UpdatedAt); err != nil {
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		revisions = append(revisions, save)
+	}
+	if len(revisions) == 0 {
+		return ErrorResponse(c, 404, "Save not found")
+	}
+	return c.JSON(fiber.Map{"revisions": revisions})
+}
+
+/**
+ * saveConflict answers a write that was based on an outdated revision with both versions,
+ * so the game can merge them or let the player choose
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*GameSave} current - Latest stored revision, including its data
+ * @param {[]byte} attempted - Data the client tried to write, or nil for a delete
+ * @returns {error} Error if any
+ */
+func saveConflict(c *fiber.Ctx, current *GameSave, attempted []byte) error {
+	c.Set("ETag", saveETag(current.Revision))
+	response := fiber.Map{"error": "Save was changed by another device", "current": current}
+	if attempted != nil {
+		response["attempted"] = fiber.Map{"data": attempted, "sizeBytes": len(attempted)}
+	}
+	return c.Status(409).JSON(response)
+}
+
+/**
+ * PutGameSave writes a new revision of a save slot from the raw request body
+ * Overwriting an existing save needs If-Match with its current revision (or *);
+ * a write based on an older revision is refused with 409 and both versions
+ * Headers: If-Match, X-Device-Id (optional, recorded with the revision)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func PutGameSave(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+	gameSlug, slot, err := saveSlotParams(c, db)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	data := append([]byte(nil), c.Body()...)
+	if len(data) == 0 {
+		return ErrorResponse(c, 400, "Save data is required")
+	}
+	maxSize := saveSizeLimits[GetUserTier(db, userId)]
+	if len(data) > maxSize {
+		return c.Status(413).JSON(fiber.Map{"error": "Save is too large for your subscription tier", "maxSizeBytes": maxSize})
+	}
+	deviceId := c.Get("X-Device-Id")
+	if len(deviceId) > maxSyncIdLength {
+		return ErrorResponse(c, 400, "X-Device-Id must be at most 128 characters")
+	}
+	contentType := saveContentType(c.Get("Content-Type"))
+	ifMatch := c.Get("If-Match")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	current, err := loadGameSave(tx, userId, gameSlug, slot, 0)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	var revision int64 = 1
+	if current != nil {
+		if ifMatch == "" {
+			return ErrorResponse(c, 428, "If-Match is required to overwrite a save")
+		}
+		if !etagMatches(ifMatch, saveETag(current.Revision)) {
+			return saveConflict(c, current, data)
+		}
+		revision = current.Revision + 1
+	} else {
+		if ifMatch != "" && strings.TrimSpace(ifMatch) != "*" {
+			return ErrorResponse(c, 404, "Save not found")
+		}
+		var slots int
+		if err := tx.QueryRow("SELECT COUNT(DISTINCT slot) FROM game_saves WHERE userId = ? AND gameSlug = ?", userId, gameSlug).Scan(&slots); err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		if slots >= maxSaveSlots {
+			return ErrorResponse(c, 409, fmt.Sprintf("A game can have at most %d save slots", maxSaveSlots))
+		}
+	}
+
+	// Revisions keep counting up across deletes; slots saved before the counter existed start from their latest revision
+	err = tx.QueryRow(`
+		INSERT INTO game_save_slots(userId, gameSlug, slot, lastRevision) VALUES (?, ?, ?, ?)
+		ON CONFLICT(userId, gameSlug, slot) DO UPDATE SET lastRevision = MAX(game_save_slots.lastRevision + 1, excluded.lastRevision)
+		RETURNING lastRevision
+	`, userId, gameSlug, slot, revision).Scan(&revision)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Failed to save", err)
+	}
+
+	save := GameSave{Slot: slot, Revision: revision, SizeBytes: len(data), ContentType: contentType, DeviceId: deviceId}
+	err = tx.QueryRow(`
+		INSERT INTO game_saves(userId, gameSlug, slot, revision, data, sizeBytes, contentType, deviceId)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING createdAt
+	`, userId, gameSlug, slot, revision, data, len(data), contentType, deviceId).Scan(&save.UpdatedAt)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Failed to save", err)
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM game_saves WHERE userId = ? AND gameSlug = ? AND slot = ? AND revision <= ?
+	`, userId, gameSlug, slot, revision-saveRevisionsKept)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Failed to save", err)
+	}
+
+	c.Set("ETag", saveETag(revision))
+	status := 200
+	if current == nil {
+		status = 201
+	}
+	return c.Status(status).JSON(save)
+}
+
+/**
+ * DeleteGameSave removes a save slot and all of its revisions
+ * The slot's revision counter is kept, so writing to it again continues from the deleted revision
+ * With If-Match, a slot that has changed since is refused with 409 and its current version
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func DeleteGameSave(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+	gameSlug, slot, err := saveSlotParams(c, db)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	current, err := loadGameSave(tx, userId, gameSlug, slot, 0)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if current == nil {
+		return ErrorResponse(c, 404, "Save not found")
+	}
+	if ifMatch := c.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, saveETag(current.Revision)) {
+		return saveConflict(c, current, nil)
+	}
+
+	if _, err := tx.Exec("DELETE FROM game_saves WHERE userId = ? AND gameSlug = ? AND slot = ?", userId, gameSlug, slot); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	return c.JSON(fiber.Map{"message": "Save deleted", "slot": slot, "revision": current.Revision})
+}
@@ -0,0 +1,631 @@
+package api
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+/**
+ * GameSyncResult describes what the sync found and did for one game directory
+ * Action is one of created, updated, unchanged or skipped
+ */
+type GameSyncResult struct {
+	Slug     string              `json:"slug"`
+	Action   string              `json:"action"`
+	Version  string              `json:"version,omitempty"`
+	Releases []ReleaseSyncResult `json:"releases"`
+	Drift    []string            `json:"drift,omitempty"`
+	Error    string              `json:"error,omitempty"`
+}
+
+/**
+ * ReleaseSyncResult describes one package found on disk, either the legacy
+ * games/<slug>/manifest.json or a games/<slug>/<version>/ release directory
+ * Action is one of registered, updated (manifest backfilled), unchanged or skipped
+ */
+type ReleaseSyncResult struct {
+	Version       string   `json:"version"`
+	ManifestPath  string   `json:"manifestPath"`
+	Action        string   `json:"action"`
+	SizeBytes     int64    `json:"sizeBytes"`
+	DeclaredSize  int64    `json:"declaredSize"`
+	ContentHash   string   `json:"contentHash"`
+	MissingAssets []string `json:"missingAssets,omitempty"`
+	Drift         []string `json:"drift,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	// Number of .br/.gz siblings written for the release's assets
+	Precompressed int `json:"precompressed,omitempty"`
+}
+
+type GameSyncReport struct {
+	Games []GameSyncResult `json:"games"`
+	// Slugs registered in the database with no directory on disk
+	Orphans []string `json:"orphans,omitempty"`
+}
+
+/**
+ * GamePackage is the result of scanning a game directory against its manifest
+ * Assets keeps the manifest's order and only includes files found on disk
+ */
+type GamePackage struct {
+	Manifest    GameManifest
+	SizeBytes   int64
+	ContentHash string
+	// Hash of the listed assets only, which releases registered before manifests were stored have
+	LegacyContentHash string
+	Assets            []ManifestAsset
+	MissingAssets     []string
+}
+
+/**
+ * ScanGamePackage reads a game's manifest.json and hashes every listed asset
+ * The content hash covers manifest.json as well, so any change to what is served changes it
+ * @param {string} gameDir - Path to the game directory
+ * @returns {*GamePackage} Scanned package
+ * @returns {error} Error if the manifest is missing or invalid
+ */
+func ScanGamePackage(gameDir string) (*GamePackage, error) {
+	manifestData, err := os.ReadFile(filepath.Join(gameDir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("manifest.json not readable: %w", err)
+	}
+
+	pkg := &GamePackage{Assets: []ManifestAsset{}}
+	pkg.Manifest, err = ParseGameManifest(manifestData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest.json: %w", err)
+	}
+
+	hashes := map[string]string{}
+
+	for _, asset := range pkg.Manifest.Assets {
+		assetPath, ok := resolveAssetPath(gameDir, asset)
+		if !ok {
+			return nil, fmt.Errorf("asset path escapes game directory: %s", asset)
+		}
+
+		sum, size, err := hashFile(assetPath)
+		if err != nil {
+			pkg.MissingAssets = append(pkg.MissingAssets, asset)
+			continue
+		}
+		hashes[asset] = hex.EncodeToString(sum)
+		pkg.Assets = append(pkg.Assets, ManifestAsset{
+			Path:      asset,
+			Size:      size,
+			Sha256:    hashes[asset],
+			Integrity: "sha256-" + base64.StdEncoding.EncodeToString(sum),
+			MimeType:  assetMimeType(asset),
+		})
+		pkg.SizeBytes += size
+	}
+
+	pkg.LegacyContentHash = combineAssetHashes(hashes)
+	manifestSum := sha256.Sum256(manifestData)
+	hashes["manifest.json"] = hex.EncodeToString(manifestSum[:])
+	pkg.ContentHash = combineAssetHashes(hashes)
+	return pkg, nil
+}
+
+/**
+ * resolveAssetPath joins a manifest asset path onto the game directory,
+ * rejecting absolute paths and paths that climb out of it
+ */
+func resolveAssetPath(gameDir string, asset string) (string, bool) {
+	if asset == "" || filepath.IsAbs(asset) || strings.HasPrefix(asset, "/") {
+		return "", false
+	}
+	cleaned := filepath.Clean(filepath.FromSlash(asset))
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.Join(gameDir, cleaned), true
+}
+
+func hashFile(path string) ([]byte, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hasher.Sum(nil), size, nil
+}
+
+/**
+ * combineAssetHashes derives a single hash for a package from its asset hashes,
+ * independent of the order assets are listed in
+ */
+func combineAssetHashes(assetHashes map[string]string) string {
+	paths := make([]string, 0, len(assetHashes))
+	for path := range assetHashes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	hasher := sha256.New()
+	for _, path := range paths {
+		fmt.Fprintf(hasher, "%s\x00%s\n", path, assetHashes[path])
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+/**
+ * SyncGames walks the games directory, registers every package it finds as a
+ * release and keeps each games row in step with its live release
+ * Existing rows keep their name, description, tier and rating. A game without a
+ * live release gets the package its row points at, or its highest version, published.
+ * Compressible assets of every valid package get .br and .gz siblings written next to them
+ * @param {*sql.DB} db - Database connection
+ * @param {string} gamesDir - Directory containing one folder per game slug
+ * @param {bool} dryRun - Report drift without writing to the database
+ * @returns {*GameSyncReport} Per-game results
+ * @returns {error} Error if the directory or database could not be read
+ */
+func SyncGames(db *sql.DB, gamesDir string, dryRun bool) (*GameSyncReport, error) {
+	entries, err := os.ReadDir(gamesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// A dry run does all the same work and then rolls the transaction back
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	report := &GameSyncReport{Games: []GameSyncResult{}}
+	onDisk := map[string]bool{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		slug := entry.Name()
+		onDisk[slug] = true
+
+		result, err := syncGame(tx, gamesDir, slug, !dryRun)
+		if err != nil {
+			return nil, err
+		}
+		report.Games = append(report.Games, result)
+	}
+
+	rows, err := tx.Query("SELECT slug FROM games ORDER BY slug ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return nil, err
+		}
+		if !onDisk[slug] {
+			report.Orphans = append(report.Orphans, slug)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	return report, tx.Commit()
+}
+
+type scannedPackage struct {
+	result ReleaseSyncResult
+	pkg    *GamePackage
+}
+
+/**
+ * scanGameDirectory finds and scans the legacy root package and every release directory
+ */
+func scanGameDirectory(gamesDir string, slug string) ([]scannedPackage, error) {
+	gameDir := filepath.Join(gamesDir, slug)
+	dirs := []string{}
+	if _, err := os.Stat(filepath.Join(gameDir, "manifest.json")); err == nil {
+		dirs = append(dirs, "")
+	}
+
+	entries, err := os.ReadDir(gameDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(gameDir, entry.Name(), "manifest.json")); err == nil {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+
+	packages := []scannedPackage{}
+	seenVersions := map[string]bool{}
+	for _, dir := range dirs {
+		packageDir := filepath.Join(gameDir, dir)
+		result := ReleaseSyncResult{Version: dir, ManifestPath: filepath.ToSlash(filepath.Join(packageDir, "manifest.json"))}
+
+		pkg, err := ScanGamePackage(packageDir)
+		switch {
+		case err != nil:
+			result.Error = err.Error()
+		case dir != "" && pkg.Manifest.Version != dir:
+			result.Error = fmt.Sprintf("manifest version %s does not match directory name", pkg.Manifest.Version)
+		case !ValidateVersion(pkg.Manifest.Version):
+			result.Error = "manifest version is not usable as a release directory name"
+		case seenVersions[pkg.Manifest.Version]:
+			result.Error = fmt.Sprintf("version %s is also present in another directory", pkg.Manifest.Version)
+		case len(pkg.MissingAssets) > 0:
+			result.Error = fmt.Sprintf("%d listed asset(s) missing; add them to the package or remove them from manifest.json", len(pkg.MissingAssets))
+		}
+
+		if pkg != nil {
+			result.Version = pkg.Manifest.Version
+			result.SizeBytes = pkg.SizeBytes
+			result.DeclaredSize = pkg.Manifest.TotalSize
+			result.ContentHash = pkg.ContentHash
+			result.MissingAssets = pkg.MissingAssets
+			if pkg.Manifest.TotalSize != pkg.SizeBytes {
+				result.Drift = append(result.Drift, fmt.Sprintf("manifest totalSize %d, assets total %d", pkg.Manifest.TotalSize, pkg.SizeBytes))
+			}
+		}
+		if result.Error != "" {
+			result.Action = "skipped"
+			pkg = nil
+		} else {
+			seenVersions[pkg.Manifest.Version] = true
+		}
+		packages = append(packages, scannedPackage{result: result, pkg: pkg})
+	}
+	return packages, nil
+}
+
+func syncGame(tx *sql.Tx, gamesDir string, slug string, precompress bool) (GameSyncResult, error) {
+	result := GameSyncResult{Slug: slug, Releases: []ReleaseSyncResult{}}
+
+	if !ValidateSlug(slug) {
+		result.Action = "skipped"
+		result.Error = "directory name is not a valid slug"
+		return result, nil
+	}
+
+	packages, err := scanGameDirectory(gamesDir, slug)
+	if err != nil {
+		return result, err
+	}
+	valid := []*scannedPackage{}
+	for i := range packages {
+		if packages[i].pkg != nil {
+			valid = append(valid, &packages[i])
+		}
+	}
+
+	var gameId, dbVersion, dbManifestPath string
+	var liveReleaseId sql.NullString
+	err = tx.QueryRow("SELECT id, version, manifestPath, liveReleaseId FROM games WHERE slug = ?", slug).
+		Scan(&gameId, &dbVersion, &dbManifestPath, &liveReleaseId)
+	isNew := err == sql.ErrNoRows
+	if err != nil && !isNew {
+		return result, err
+	}
+
+	// Without a live release, publish the package matching the row, the legacy
+	// root package, or failing those the highest version present
+	var candidate *scannedPackage
+	if !liveReleaseId.Valid {
+		for _, scanned := range valid {
+			if !isNew && scanned.result.ManifestPath == dbManifestPath {
+				candidate = scanned
+			}
+		}
+		for _, scanned := range valid {
+			if candidate == nil && !isNew && scanned.pkg.Manifest.Version == dbVersion {
+				candidate = scanned
+			}
+		}
+		for _, scanned := range valid {
+			if candidate == nil && path.Dir(scanned.result.ManifestPath) == filepath.ToSlash(filepath.Join(gamesDir, slug)) {
+				candidate = scanned
+			}
+		}
+		if candidate == nil {
+			for _, scanned := range valid {
+				if candidate == nil || CompareVersions(scanned.pkg.Manifest.Version, candidate.pkg.Manifest.Version) > 0 {
+					candidate = scanned
+				}
+			}
+		}
+	}
+
+	if isNew {
+		if candidate == nil {
+			result.Releases = releaseResults(packages)
+			result.Action = "skipped"
+			result.Error = "no valid package found"
+			return result, nil
+		}
+		rating := candidate.pkg.Manifest.ContentRating
+		if rating == "" {
+			rating = "everyone"
+		}
+		gameId = uuid.New().String()
+		_, err = tx.Exec(`
+			INSERT INTO games(id, slug, name, description, version, manifestPath, sizeBytes, contentHash, rating)
+			VALUES (?, ?, ?, '', ?, ?, ?, ?, ?)
+		`, gameId, slug, titleFromSlug(slug), candidate.pkg.Manifest.Version, candidate.result.ManifestPath, candidate.pkg.SizeBytes, candidate.pkg.ContentHash, rating)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	changed := isNew
+	for _, scanned := range valid {
+		var releaseId, manifestPath, contentHash, manifestJson string
+		err := tx.QueryRow(`
+			SELECT id, manifestPath, COALESCE(contentHash, ''), COALESCE(manifestJson, '')
+			FROM game_releases WHERE gameId = ? AND version = ?
+		`, gameId, scanned.pkg.Manifest.Version).Scan(&releaseId, &manifestPath, &contentHash, &manifestJson)
+
+		switch {
+		case err == sql.ErrNoRows:
+			releaseId, err = createRelease(tx, gameId, scanned.result.ManifestPath, scanned.pkg)
+			if err != nil {
+				return result, err
+			}
+			scanned.result.Action = "registered"
+			changed = true
+		case err != nil:
+			return result, err
+		case manifestPath != scanned.result.ManifestPath:
+			scanned.result.Action = "skipped"
+			scanned.result.Error = "version already registered from " + manifestPath
+		default:
+			scanned.result.Action = "unchanged"
+			// Releases without a stored manifest were hashed without manifest.json, so also accept the old hash
+			legacy := manifestJson == "" && contentHash == scanned.pkg.LegacyContentHash
+			if contentHash != scanned.pkg.ContentHash && !legacy {
+				scanned.result.Drift = append(scanned.result.Drift, "files changed on disk since the release was registered")
+			} else if manifestJson == "" {
+				if err := storeReleaseManifest(tx, releaseId, scanned.pkg); err != nil {
+					return result, err
+				}
+				scanned.result.Action = "updated"
+				changed = true
+			}
+		}
+
+		if scanned == candidate && scanned.result.Error == "" {
+			if err := publishRelease(tx, gameId, releaseId); err != nil {
+				return result, err
+			}
+			liveReleaseId = sql.NullString{String: releaseId, Valid: true}
+			changed = true
+		}
+
+		if precompress && scanned.result.Error == "" {
+			packageDir := filepath.FromSlash(path.Dir(scanned.result.ManifestPath))
+			written, err := PrecompressGamePackage(packageDir, scanned.pkg.Assets)
+			if err != nil {
+				return result, fmt.Errorf("precompressing %s: %w", packageDir, err)
+			}
+			scanned.result.Precompressed = written
+		}
+	}
+	result.Releases = releaseResults(packages)
+
+	if !liveReleaseId.Valid {
+		result.Drift = append(result.Drift, "no live release; publish one with the admin API")
+	} else {
+		drift, err := syncLiveRelease(tx, gameId, liveReleaseId.String)
+		if err != nil {
+			return result, err
+		}
+		// Also fills the catalog for games whose live release predates it
+		if err := syncAchievementCatalog(tx, gameId, liveReleaseId.String); err != nil {
+			return result, err
+		}
+		if len(drift) > 0 {
+			changed = true
+		}
+		result.Drift = append(result.Drift, drift...)
+		tx.QueryRow("SELECT version FROM games WHERE id = ?", gameId).Scan(&result.Version)
+	}
+
+	missing, err := missingReleaseDirectories(tx, gameId)
+	if err != nil {
+		return result, err
+	}
+	result.Drift = append(result.Drift, missing...)
+
+	switch {
+	case isNew:
+		result.Action = "created"
+	case changed:
+		result.Action = "updated"
+	default:
+		result.Action = "unchanged"
+	}
+	return result, nil
+}
+
+/**
+ * CompareVersions orders dotted version strings, comparing numeric parts as numbers
+ * @param {string} a - First version
+ * @param {string} b - Second version
+ * @returns {int} Negative if a < b, zero if equal, positive if a > b
+ */
+func CompareVersions(a string, b string) int {
+	aParts := strings.FieldsFunc(a, isVersionSeparator)
+	bParts := strings.FieldsFunc(b, isVersionSeparator)
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aNumber, aErr := strconv.Atoi(aParts[i])
+		bNumber, bErr := strconv.Atoi(bParts[i])
+		switch {
+		case aErr == nil && bErr == nil && aNumber != bNumber:
+			return aNumber - bNumber
+		case (aErr != nil || bErr != nil) && aParts[i] != bParts[i]:
+			return strings.Compare(aParts[i], bParts[i])
+		}
+	}
+	return len(aParts) - len(bParts)
+}
+
+func isVersionSeparator(r rune) bool {
+	return r == '.' || r == '-' || r == '+' || r == '_'
+}
+
+func releaseResults(packages []scannedPackage) []ReleaseSyncResult {
+	results := make([]ReleaseSyncResult, len(packages))
+	for i, scanned := range packages {
+		results[i] = scanned.result
+	}
+	return results
+}
+
+/**
+ * syncLiveRelease copies the live release's details onto the games row,
+ * returning a description of every field that was out of step
+ */
+func syncLiveRelease(tx *sql.Tx, gameId string, releaseId string) ([]string, error) {
+	var gameVersion, gameManifestPath, gameHash, releaseVersion, releaseManifestPath, releaseHash string
+	var gameSize, releaseSize int64
+	err := tx.QueryRow(`
+		SELECT g.version, g.manifestPath, COALESCE(g.sizeBytes, 0), COALESCE(g.contentHash, ''),
+			r.version, r.manifestPath, COALESCE(r.sizeBytes, 0), COALESCE(r.contentHash, '')
+		FROM games g JOIN game_releases r ON r.id = g.liveReleaseId
+		WHERE g.id = ? AND r.id = ?
+	`, gameId, releaseId).Scan(&gameVersion, &gameManifestPath, &gameSize, &gameHash, &releaseVersion, &releaseManifestPath, &releaseSize, &releaseHash)
+	if err != nil {
+		return nil, err
+	}
+
+	drift := []string{}
+	if gameVersion != releaseVersion {
+		drift = append(drift, fmt.Sprintf("database version %s, live release %s", gameVersion, releaseVersion))
+	}
+	if gameManifestPath != releaseManifestPath {
+		drift = append(drift, fmt.Sprintf("database manifestPath %s, live release %s", gameManifestPath, releaseManifestPath))
+	}
+	if gameSize != releaseSize {
+		drift = append(drift, fmt.Sprintf("database sizeBytes %d, live release %d", gameSize, releaseSize))
+	}
+	if gameHash != releaseHash {
+		drift = append(drift, "database contentHash differs from live release")
+	}
+	if len(drift) == 0 {
+		return nil, nil
+	}
+	return drift, mirrorLiveRelease(tx, gameId, releaseId)
+}
+
+func missingReleaseDirectories(tx *sql.Tx, gameId string) ([]string, error) {
+	rows, err := tx.Query("SELECT version, manifestPath FROM game_releases WHERE gameId = ? ORDER BY createdAt ASC", gameId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	missing := []string{}
+	for rows.Next() {
+		var version, manifestPath string
+		if err := rows.Scan(&version, &manifestPath); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filepath.FromSlash(manifestPath)); err != nil {
+			missing = append(missing, fmt.Sprintf("release %s registered but %s is missing", version, manifestPath))
+		}
+	}
+	return missing, rows.Err()
+}
+
+func titleFromSlug(slug string) string {
+	words := strings.Split(slug, "-")
+	for i, word := range words {
+		words[i] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+/**
+ * PrintGameSyncReport writes a human-readable summary of a sync
+ * @param {io.Writer} w - Output destination
+ * @param {*GameSyncReport} report - Report to print
+ * @param {bool} dryRun - Whether the sync was a dry run
+ */
+func PrintGameSyncReport(w io.Writer, report *GameSyncReport, dryRun bool) {
+	if dryRun {
+		fmt.Fprintln(w, "Dry run: no changes written")
+	}
+	for _, result := range report.Games {
+		fmt.Fprintf(w, "%-10s %s", result.Action, result.Slug)
+		if result.Version != "" {
+			fmt.Fprintf(w, " (live v%s)", result.Version)
+		}
+		fmt.Fprintln(w)
+		if result.Error != "" {
+			fmt.Fprintf(w, "           error: %s\n", result.Error)
+		}
+		for _, drift := range result.Drift {
+			fmt.Fprintf(w, "           drift: %s\n", drift)
+		}
+		for _, release := range result.Releases {
+			fmt.Fprintf(w, "           %-10s %s (%d bytes", release.Action, release.ManifestPath, release.SizeBytes)
+			if release.Precompressed > 0 {
+				fmt.Fprintf(w, ", %d precompressed", release.Precompressed)
+			}
+			fmt.Fprintln(w, ")")
+			if release.Error != "" {
+				fmt.Fprintf(w, "                      error: %s\n", release.Error)
+			}
+			for _, asset := range release.MissingAssets {
+				fmt.Fprintf(w, "                      missing asset: %s\n", asset)
+			}
+			for _, drift := range release.Drift {
+				fmt.Fprintf(w, "                      drift: %s\n", drift)
+			}
+		}
+	}
+	for _, slug := range report.Orphans {
+		fmt.Fprintf(w, "%-10s %s (in database, no game directory)\n", "orphan", slug)
+	}
+}
+
+/**
+ * HasErrors reports whether any game or release had to be skipped
+ * @returns {bool} True if at least one game or release was skipped
+ */
+func (report *GameSyncReport) HasErrors() bool {
+	for _, result := range report.Games {
+		if result.Error != "" {
+			return true
+		}
+		for _, release := range result.Releases {
+			if release.Error != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,464 @@
+package api
+
+import (
+	"archive/zip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	MaxGameBundleBytes    = 200 << 20
+	maxGameExtractedBytes = 500 << 20
+	maxGameBundleFiles    = 5000
+)
+
+var (
+	GamesDir       = "games"
+	GameStagingDir = "game-staging"
+)
+
+// File types a game bundle may contain, keyed by lowercase extension
+var allowedGameFileTypes = map[string]string{
+	".html": "text/html", ".htm": "text/html", ".js": "text/javascript", ".mjs": "text/javascript",
+	".css": "text/css", ".json": "application/json", ".map": "application/json", ".xml": "application/xml",
+	".txt": "text/plain", ".md": "text/markdown", ".wasm": "application/wasm",
+	".png": "image/png", ".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".gif": "image/gif",
+	".webp": "image/webp", ".svg": "image/svg+xml", ".ico": "image/x-icon",
+	".mp3": "audio/mpeg", ".ogg": "audio/ogg", ".wav": "audio/wav", ".m4a": "audio/mp4",
+	".mp4": "video/mp4", ".webm": "video/webm",
+	".woff": "font/woff", ".woff2": "font/woff2", ".ttf": "font/ttf", ".otf": "font/otf",
+}
+
+/**
+ * GameMetadataRequest holds editable catalog fields; nil fields are left unchanged
+ */
+type GameMetadataRequest struct {
+	Name         *string `json:"name"`
+	Description  *string `json:"description"`
+	TierRequired *string `json:"tierRequired"`
+	Rating       *string `json:"rating"`
+}
+
+func (metadata GameMetadataRequest) validate() error {
+	if metadata.Name != nil && strings.TrimSpace(*metadata.Name) == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "Name cannot be empty")
+	}
+	if metadata.TierRequired != nil && !containsString(subscriptionTiers, *metadata.TierRequired) {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid tierRequired")
+	}
+	if metadata.Rating != nil {
+		if _, ok := ratingHierarchy[*metadata.Rating]; !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid rating")
+		}
+	}
+	return nil
+}
+
+func formValue(c *fiber.Ctx, key string) *string {
+	if value := c.FormValue(key); value != "" {
+		return &value
+	}
+	return nil
+}
+
+/**
+ * extractGameBundle unpacks a zip into dest after checking every entry
+ * A single top-level folder wrapping the whole bundle is stripped
+ */
+func extractGameBundle(reader *zip.Reader, dest string) error {
+	if len(reader.File) > maxGameBundleFiles {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Bundle has more than %d files", maxGameBundleFiles))
+	}
+
+	prefix := commonBundlePrefix(reader.File)
+	var extracted int64
+
+	for _, file := range reader.File {
+		name := strings.TrimPrefix(file.Name, prefix)
+		if name == "" || strings.HasSuffix(name, "/") || isIgnoredBundleFile(name) {
+			continue
+		}
+
+		if strings.Contains(name, "\\") || path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid path in bundle: "+file.Name)
+		}
+		if !file.Mode().IsRegular() {
+			return fiber.NewError(fiber.StatusBadRequest, "Bundle may only contain regular files: "+file.Name)
+		}
+		if _, ok := allowedGameFileTypes[strings.ToLower(path.Ext(name))]; !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "File type not allowed: "+file.Name)
+		}
+
+		extracted += int64(file.UncompressedSize64)
+		if extracted > maxGameExtractedBytes {
+			return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Bundle is too large when extracted")
+		}
+
+		target := filepath.Join(dest, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := extractBundleFile(file, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractBundleFile(file *zip.File, target string) error {
+	src, err := file.Open()
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Corrupt bundle entry: "+file.Name)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// The header size can lie, so never write more than it declared
+	written, err := io.Copy(dst, io.LimitReader(src, int64(file.UncompressedSize64)+1))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Corrupt bundle entry: "+file.Name)
+	}
+	if written != int64(file.UncompressedSize64) {
+		return fiber.NewError(fiber.StatusBadRequest, "Bundle entry size mismatch: "+file.Name)
+	}
+	return nil
+}
+
+func commonBundlePrefix(files []*zip.File) string {
+	prefix := ""
+	for _, file := range files {
+		if isIgnoredBundleFile(file.Name) {
+			continue
+		}
+		slash := strings.Index(file.Name, "/")
+		if slash < 0 {
+			return ""
+		}
+		if prefix == "" {
+			prefix = file.Name[:slash+1]
+		} else if !strings.HasPrefix(file.Name, prefix) {
+			return ""
+		}
+	}
+	for _, file := range files {
+		if file.Name == prefix+"manifest.json" {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// Metadata that archivers add and that should never be published
+func isIgnoredBundleFile(name string) bool {
+	return strings.HasPrefix(name, "__MACOSX/") || path.Base(name) == ".DS_Store"
+}
+
+/**
+ * UploadGame stores a zipped game bundle as a new release (admin only)
+ * Multipart fields: bundle (zip), slug, and optional name, description, tierRequired,
+ * rating and publish (default true; a game's first release is always published)
+ * The bundle is extracted and validated in a staging directory, then moved to
+ * games/<slug>/<version>/, which is never modified afterwards
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func UploadGame(c *fiber.Ctx, db *sql.DB) error {
+	slug := c.FormValue("slug")
+	if !ValidateSlug(slug) {
+		return ErrorResponse(c, 400, "Invalid slug")
+	}
+
+	metadata := GameMetadataRequest{
+		Name:         formValue(c, "name"),
+		Description:  formValue(c, "description"),
+		TierRequired: formValue(c, "tierRequired"),
+		Rating:       formValue(c, "rating"),
+	}
+	if err := metadata.validate(); err != nil {
+		return FiberErrorResponse(c, err, "Invalid metadata")
+	}
+	publish := c.FormValue("publish", "true") != "false"
+
+	fileHeader, err := c.FormFile("bundle")
+	if err != nil {
+		return ErrorResponse(c, 400, "bundle file is required")
+	}
+	if fileHeader.Size > MaxGameBundleBytes {
+		return ErrorResponse(c, 413, "Bundle is too large")
+	}
+
+	bundle, err := fileHeader.Open()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Could not read upload", err)
+	}
+	defer bundle.Close()
+
+	reader, err := zip.NewReader(bundle, fileHeader.Size)
+	if err != nil {
+		return ErrorResponse(c, 400, "bundle is not a valid zip file")
+	}
+
+	if err := os.MkdirAll(GameStagingDir, 0755); err != nil {
+		return StandardErrorResponse(c, 500, "Could not create staging directory", err)
+	}
+	stagingDir, err := os.MkdirTemp(GameStagingDir, slug+"-")
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Could not create staging directory", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	if err := extractGameBundle(reader, stagingDir); err != nil {
+		return FiberErrorResponse(c, err, "Could not extract bundle")
+	}
+
+	pkg, err := ScanGamePackage(stagingDir)
+	var validationErr *ManifestValidationError
+	if errors.As(err, &validationErr) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid manifest.json", "problems": validationErr.Problems})
+	}
+	if err != nil {
+		return ErrorResponse(c, 400, err.Error())
+	}
+	if !ValidateVersion(pkg.Manifest.Version) {
+		return ErrorResponse(c, 400, "Manifest version may only contain letters, digits, '.', '+', '_' and '-'")
+	}
+	if len(pkg.MissingAssets) > 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Manifest lists assets missing from the bundle", "missingAssets": pkg.MissingAssets})
+	}
+	if entryPath, ok := resolveAssetPath(stagingDir, pkg.Manifest.EntryPoint); !ok {
+		return ErrorResponse(c, 400, "Invalid entryPoint")
+	} else if info, err := os.Stat(entryPath); err != nil || !info.Mode().IsRegular() {
+		return ErrorResponse(c, 400, "entryPoint not found in bundle: "+pkg.Manifest.EntryPoint)
+	}
+
+	releaseDir := filepath.Join(GamesDir, slug, pkg.Manifest.Version)
+	if _, err := os.Stat(releaseDir); err == nil {
+		return ErrorResponse(c, 409, "Version "+pkg.Manifest.Version+" already exists; bump the manifest version")
+	}
+
+	if _, err := PrecompressGamePackage(stagingDir, pkg.Assets); err != nil {
+		return StandardErrorResponse(c, 500, "Could not compress game files", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	gameId, status, err := saveUploadedRelease(tx, slug, pkg, metadata, publish)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(releaseDir), 0755); err != nil {
+		return StandardErrorResponse(c, 500, "Could not store game files", err)
+	}
+	if err := os.Rename(stagingDir, releaseDir); err != nil {
+		return StandardErrorResponse(c, 500, "Could not store game files", err)
+	}
+	if err := tx.Commit(); err != nil {
+		os.RemoveAll(releaseDir)
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	log.Printf("Game %s release %s uploaded", slug, pkg.Manifest.Version)
+
+	game, err := getAdminGame(db, gameId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	release, err := scanRelease(db.QueryRow("SELECT "+releaseColumns+" FROM game_releases WHERE gameId = ? AND version = ?", gameId, pkg.Manifest.Version))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	return c.Status(status).JSON(fiber.Map{"game": game, "release": release})
+}
+
+/**
+ * saveUploadedRelease records the release and creates the games row if needed
+ * Returns 201 when the game itself is new
+ */
+func saveUploadedRelease(tx *sql.Tx, slug string, pkg *GamePackage, metadata GameMetadataRequest, publish bool) (string, int, error) {
+	manifestPath := filepath.ToSlash(filepath.Join(GamesDir, slug, pkg.Manifest.Version, "manifest.json"))
+	status := 200
+
+	var gameId string
+	err := tx.QueryRow("SELECT id FROM games WHERE slug = ?", slug).Scan(&gameId)
+	if err == sql.ErrNoRows {
+		name := titleFromSlug(slug)
+		if metadata.Name != nil {
+			name = *metadata.Name
+		}
+		gameId = uuid.New().String()
+		_, err = tx.Exec(`
+			INSERT INTO games(id, slug, name, description, version, manifestPath, sizeBytes, contentHash)
+			VALUES (?, ?, ?, '', ?, ?, ?, ?)
+		`, gameId, slug, name, pkg.Manifest.Version, manifestPath, pkg.SizeBytes, pkg.ContentHash)
+		metadata.Name = nil
+		if metadata.Rating == nil && pkg.Manifest.ContentRating != "" {
+			metadata.Rating = &pkg.Manifest.ContentRating
+		}
+		status = 201
+		publish = true
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	var existing int
+	err = tx.QueryRow("SELECT COUNT(*) FROM game_releases WHERE gameId = ? AND version = ?", gameId, pkg.Manifest.Version).Scan(&existing)
+	if err != nil {
+		return "", 0, err
+	}
+	if existing > 0 {
+		return "", 0, fiber.NewError(fiber.StatusConflict, "Version "+pkg.Manifest.Version+" already exists; bump the manifest version")
+	}
+
+	releaseId, err := createRelease(tx, gameId, manifestPath, pkg)
+	if err != nil {
+		return "", 0, err
+	}
+	if publish {
+		if _, err := tx.Exec("UPDATE games SET retiredAt = NULL WHERE id = ?", gameId); err != nil {
+			return "", 0, err
+		}
+		if err := publishRelease(tx, gameId, releaseId); err != nil {
+			return "", 0, err
+		}
+	}
+	return gameId, status, applyGameMetadata(tx, gameId, metadata)
+}
+
+func applyGameMetadata(tx *sql.Tx, gameId string, metadata GameMetadataRequest) error {
+	sets := []string{}
+	args := []interface{}{}
+	if metadata.Name != nil {
+		sets = append(sets, "name = ?")
+		args = append(args, strings.TrimSpace(*metadata.Name))
+	}
+	if metadata.Description != nil {
+		sets = append(sets, "description = ?")
+		args = append(args, *metadata.Description)
+	}
+	if metadata.TierRequired != nil {
+		sets = append(sets, "tierRequired = ?")
+		args = append(args, *metadata.TierRequired)
+	}
+	if metadata.Rating != nil {
+		sets = append(sets, "rating = ?")
+		args = append(args, *metadata.Rating)
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
+	args = append(args, gameId)
+	_, err := tx.Exec("UPDATE games SET "+strings.Join(sets, ", ")+", updatedAt = CURRENT_TIMESTAMP WHERE id = ?", args...)
+	return err
+}
+
+/**
+ * AdminGame is the admin view of a games row, including retired games
+ */
+type AdminGame struct {
+	Game
+	ContentHash   string `json:"contentHash"`
+	LiveReleaseId string `json:"liveReleaseId,omitempty"`
+	RetiredAt     string `json:"retiredAt,omitempty"`
+}
+
+func getAdminGame(db *sql.DB, gameId string) (AdminGame, error) {
+	var game AdminGame
+	var liveReleaseId, retiredAt sql.NullString
+	err := db.QueryRow(`
+		SELECT id, slug, name, COALESCE(description, ''), version, tierRequired, manifestPath, sizeBytes, rating,
+			COALESCE(contentHash, ''), liveReleaseId, retiredAt, createdAt, updatedAt
+		FROM games WHERE id = ?
+	`, gameId).Scan(&game.Id, &game.Slug, &game.Name, &game.Description, &game.Version, &game.TierRequired, &game.ManifestPath,
+		&game.SizeBytes, &game.Rating, &game.ContentHash, &liveReleaseId, &retiredAt, &game.CreatedAt, &game.UpdatedAt)
+	game.LiveReleaseId = liveReleaseId.String
+	game.RetiredAt = retiredAt.String
+	return game, err
+}
+
+/**
+ * UpdateGameMetadata edits a game's name, description, tier or rating (admin only)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func UpdateGameMetadata(c *fiber.Ctx, db *sql.DB) error {
+	var metadata GameMetadataRequest
+	if err := c.BodyParser(&metadata); err != nil {
+		return ErrorResponse(c, 400, "Invalid request body")
+	}
+	if err := metadata.validate(); err != nil {
+		return FiberErrorResponse(c, err, "Invalid metadata")
+	}
+
+	var gameId string
+	err := db.QueryRow("SELECT id FROM games WHERE slug = ?", c.Params("slug")).Scan(&gameId)
+	if err == sql.ErrNoRows {
+		return ErrorResponse(c, 404, "Game not found")
+	}
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	if err := applyGameMetadata(tx, gameId, metadata); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	game, err := getAdminGame(db, gameId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	return c.JSON(game)
+}
+
+/**
+ * RetireGame hides a game from the catalog and manifest API (admin only)
+ * Files, entitlements and player progression are kept; uploading a new version un-retires it
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func RetireGame(c *fiber.Ctx, db *sql.DB) error {
+	result, err := db.Exec(`
+		UPDATE games SET retiredAt = COALESCE(retiredAt, CURRENT_TIMESTAMP), updatedAt = CURRENT_TIMESTAMP
+		WHERE slug = ?
+	`, c.Params("slug"))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrorResponse(c, 404, "Game not found")
+	}
+	return c.JSON(fiber.Map{"message": "Game retired"})
+}
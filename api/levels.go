@@ -0,0 +1,258 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// Without a configured curve, reaching level L takes 50 * L * (L - 1) XP: 100 for level 2, 300 for level 3, ...
+	defaultLevelXpStep = 50
+	defaultMaxLevel    = 100
+
+	LedgerReasonLevelUp = "level_up"
+)
+
+/**
+ * LevelDefinition is one step of the level curve and what reaching it awards
+ * XpRequired is the total XP needed for the level, not the XP since the previous one
+ */
+type LevelDefinition struct {
+	Level       int      `json:"level"`
+	XpRequired  int      `json:"xpRequired"`
+	CoinReward  int      `json:"coinReward,omitempty"`
+	RewardItems []string `json:"rewardItems,omitempty"`
+}
+
+/**
+ * defaultLevelCurve builds the curve used when no levels are configured
+ * @returns {[]LevelDefinition} Levels 1 to defaultMaxLevel, without rewards
+ */
+func defaultLevelCurve() []LevelDefinition {
+	curve := make([]LevelDefinition, 0, defaultMaxLevel)
+	for level := 1; level <= defaultMaxLevel; level++ {
+		curve = append(curve, LevelDefinition{Level: level, XpRequired: defaultLevelXpStep * level * (level - 1)})
+	}
+	return curve
+}
+
+/**
+ * loadLevelCurve reads the configured level curve, or the default one if none is configured
+ * @param {queryer} db - Database connection or transaction
+ * @returns {[]LevelDefinition, bool, error} Levels in order, whether they are configured, and error if any
+ */
+func loadLevelCurve(db queryer) ([]LevelDefinition, bool, error) {
+	rows, err := db.Query("SELECT level, xpRequired, coinReward, rewardItems FROM levels ORDER BY level")
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	curve := []LevelDefinition{}
+	for rows.Next() {
+		var level LevelDefinition
+		var rewardItemsJSON string
+		if err := rows.Scan(&level.Level, &level.XpRequired, &level.CoinReward, &rewardItemsJSON); err != nil {
+			return nil, false, err
+		}
+		json.Unmarshal([]byte(rewardItemsJSON), &level.RewardItems)
+		curve = append(curve, level)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if len(curve) == 0 {
+		return defaultLevelCurve(), false, nil
+	}
+	return curve, true, nil
+}
+
+/**
+ * checkLevelCurve validates a level curve before it replaces the configured one
+ * @param {[]LevelDefinition} curve - Levels in order
+ * @returns {[]string} Problems found
+ */
+func checkLevelCurve(curve []LevelDefinition) []string {
+	problems := []string{}
+	for i, level := range curve {
+		if level.Level != i+1 {
+			problems = append(problems, fmt.Sprintf("levels must be numbered 1, 2, 3, ... in order; found %d at position %d", level.Level, i+1))
+		}
+		if i == 0 && level.XpRequired != 0 {
+			problems = append(problems, "level 1 must require 0 XP")
+		}
+		if i > 0 && level.XpRequired <= curve[i-1].XpRequired {
+			problems = append(problems, fmt.Sprintf("level %d must require more XP than level %d", level.Level, curve[i-1].Level))
+		}
+		if level.CoinReward < 0 {
+			problems = append(problems, fmt.Sprintf("level %d cannot have a negative coin reward", level.Level))
+		}
+		for _, item := range level.RewardItems {
+			if item == "" || len(item) > maxSyncIdLength {
+				problems = append(problems, fmt.Sprintf("level %d reward items must be 1-128 characters", level.Level))
+				break
+			}
+		}
+	}
+	return problems
+}
+
+/**
+ * levelForXp finds the level a total amount of XP reaches
+ * @param {[]LevelDefinition} curve - Levels in order, starting at level 1 with 0 XP
+ * @param {int} xp - Total XP
+ * @returns {int} Index into curve of the level reached
+ */
+func levelForXp(curve []LevelDefinition, xp int) int {
+	index := 0
+	for index+1 < len(curve) && curve[index+1].XpRequired <= xp {
+		index++
+	}
+	return index
+}
+
+/**
+ * setLevel fills in the progression's level and the XP towards the next one
+ * At the top of the curve NextLevelXp and XpToNextLevel are left at 0
+ * @param {[]LevelDefinition} curve - Level curve
+ */
+func (progression *UserProgression) setLevel(curve []LevelDefinition) {
+	index := levelForXp(curve, progression.Xp)
+	progression.Level = curve[index].Level
+	progression.LevelXp = curve[index].XpRequired
+	progression.NextLevelXp, progression.XpToNextLevel = 0, 0
+	if index+1 < len(curve) {
+		progression.NextLevelXp = curve[index+1].XpRequired
+		progression.XpToNextLevel = progression.NextLevelXp - progression.Xp
+	}
+}
+
+/**
+ * applyLevelUps grants the rewards of every level a sync's XP reached for the first time
+ * The highest rewarded level is stored, so lowering the curve later does not pay a level twice
+ * @param {*sql.Tx} tx - The sync's transaction
+ * @param {string} userId - User ID
+ * @param {ProgressionSyncRequest} syncReq - Request the XP came from
+ * @param {[]LevelDefinition} curve - Level curve
+ * @param {int} previousXp - XP before the sync
+ * @param {*UserProgression} progression - Progression after the sync; rewards are added to it
+ * @returns {[]LevelDefinition, error} Levels reached, with the rewards that were granted, and error if any
+ */
+func applyLevelUps(tx *sql.Tx, userId string, syncReq ProgressionSyncRequest, curve []LevelDefinition, previousXp int, progression *UserProgression) ([]LevelDefinition, error) {
+	var rewardedLevel int
+	err := tx.QueryRow("SELECT level FROM user_progression WHERE userId = ?", userId).Scan(&rewardedLevel)
+	if err != nil {
+		return nil, err
+	}
+	// Progression from before levels existed has no rewarded level yet; only levels reached from now on pay out
+	if rewardedLevel == 0 {
+		rewardedLevel = curve[levelForXp(curve, previousXp)].Level
+	}
+
+	levelUps := []LevelDefinition{}
+	entries := []LedgerEntry{}
+	var coins int
+	reached := curve[levelForXp(curve, progression.Xp)].Level
+	for _, level := range curve {
+		if level.Level <= rewardedLevel || level.Level > reached {
+			continue
+		}
+		reward := LedgerEntry{
+			UserId:          userId,
+			GameSlug:        syncReq.GameSlug,
+			DeviceId:        syncReq.DeviceId,
+			BatchId:         syncReq.BatchId,
+			Reason:          LedgerReasonLevelUp,
+			ClientTimestamp: syncReq.ClientLastSyncedAt,
+		}
+		if level.CoinReward > 0 {
+			reward.Kind, reward.ItemId, reward.Delta = LedgerCoins, fmt.Sprintf("level-%d", level.Level), level.CoinReward
+			entries = append(entries, reward)
+			coins += level.CoinReward
+		}
+		for _, item := range newStrings(progression.UnlockedItems, level.RewardItems) {
+			reward.Kind, reward.ItemId, reward.Delta = LedgerItem, item, 1
+			entries = append(entries, reward)
+			progression.UnlockedItems = append(progression.UnlockedItems, item)
+		}
+		levelUps = append(levelUps, level)
+	}
+	if reached > rewardedLevel {
+		rewardedLevel = reached
+	}
+
+	unlockedItemsJSON, _ := json.Marshal(progression.UnlockedItems)
+	err = tx.QueryRow(`
+		UPDATE user_progression SET coins = coins + ?, unlockedItems = ?, level = ?
+		WHERE userId = ?
+		RETURNING coins
+	`, coins, string(unlockedItemsJSON), rewardedLevel, userId).Scan(&progression.Coins)
+	if err != nil {
+		return nil, err
+	}
+	return levelUps, appendLedgerEntries(tx, entries)
+}
+
+/**
+ * GetLevels returns the level curve
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetLevels(c *fiber.Ctx, db *sql.DB) error {
+	curve, configured, err := loadLevelCurve(db)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	return c.JSON(fiber.Map{"levels": curve, "configured": configured})
+}
+
+/**
+ * UpdateLevels replaces the level curve (admin only)
+ * An empty list goes back to the default curve. Users keep the levels they have already been rewarded for
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func UpdateLevels(c *fiber.Ctx, db *sql.DB) error {
+	var body struct {
+		Levels []LevelDefinition `json:"levels"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return ErrorResponse(c, 400, "Invalid request body")
+	}
+	if problems := checkLevelCurve(body.Levels); len(problems) > 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid level curve", "problems": problems})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM levels"); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	for _, level := range body.Levels {
+		rewardItemsJSON, _ := json.Marshal(newStrings(nil, level.RewardItems))
+		_, err := tx.Exec("INSERT INTO levels(level, xpRequired, coinReward, rewardItems) VALUES (?, ?, ?, ?)",
+			level.Level, level.XpRequired, level.CoinReward, string(rewardItemsJSON))
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Failed to save level curve", err)
+		}
+	}
+
+	curve, configured, err := loadLevelCurve(tx)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Failed to save level curve", err)
+	}
+	return c.JSON(fiber.Map{"levels": curve, "configured": configured})
+}
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"mime"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+/**
+ * ManifestAsset describes one file of a release in a v2 manifest
+ * Integrity is a Subresource Integrity string usable with fetch() and <script integrity>
+ */
+type ManifestAsset struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256"`
+	Integrity string `json:"integrity"`
+	MimeType  string `json:"mimeType"`
+	Url       string `json:"url,omitempty"`
+}
+
+/**
+ * GameManifestV2 is the server-generated manifest of a release
+ * ContentHash changes whenever manifest.json or any listed asset does and is sent as the ETag
+ */
+type GameManifestV2 struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Version       string          `json:"version"`
+	EntryPoint    string          `json:"entryPoint"`
+	Assets        []ManifestAsset `json:"assets"`
+	TotalSize     int64           `json:"totalSize"`
+	ContentHash   string          `json:"contentHash"`
+	LastUpdated   string          `json:"lastUpdated,omitempty"`
+	// Launcher metadata copied from manifest.json
+	MinEngineVersion string                `json:"minEngineVersion,omitempty"`
+	Orientation      string                `json:"orientation,omitempty"`
+	InputMethods     []string              `json:"inputMethods,omitempty"`
+	RequiredFeatures []string              `json:"requiredFeatures,omitempty"`
+	ContentRating    string                `json:"contentRating,omitempty"`
+	Thumbnail        string                `json:"thumbnail,omitempty"`
+	Screenshots      []string              `json:"screenshots,omitempty"`
+	Progression      []string              `json:"progression,omitempty"`
+	EarningLimits    *EarningLimits        `json:"earningLimits,omitempty"`
+	Achievements     []ManifestAchievement `json:"achievements,omitempty"`
+	BaseUrl          string                `json:"baseUrl,omitempty"`
+	AssetQuery       string                `json:"assetQuery,omitempty"`
+	UrlsExpireAt     string                `json:"urlsExpireAt,omitempty"`
+}
+
+/**
+ * BuildManifestV2 generates the v2 manifest for a scanned package
+ * @param {*GamePackage} pkg - Package scanned from disk
+ * @returns {GameManifestV2} Manifest with sizes and hashes taken from the files themselves
+ */
+func BuildManifestV2(pkg *GamePackage) GameManifestV2 {
+	return GameManifestV2{
+		SchemaVersion: 2,
+		Version:       pkg.Manifest.Version,
+		EntryPoint:    pkg.Manifest.EntryPoint,
+		Assets:        pkg.Assets,
+		TotalSize:     pkg.SizeBytes,
+		ContentHash:   pkg.ContentHash,
+		LastUpdated:   pkg.Manifest.LastUpdated,
+
+		MinEngineVersion: pkg.Manifest.MinEngineVersion,
+		Orientation:      pkg.Manifest.Orientation,
+		InputMethods:     pkg.Manifest.InputMethods,
+		RequiredFeatures: pkg.Manifest.RequiredFeatures,
+		ContentRating:    pkg.Manifest.ContentRating,
+		Thumbnail:        pkg.Manifest.Thumbnail,
+		Screenshots:      pkg.Manifest.Screenshots,
+		Progression:      pkg.Manifest.Progression,
+		EarningLimits:    pkg.Manifest.EarningLimits,
+		Achievements:     pkg.Manifest.Achievements,
+	}
+}
+
+func assetMimeType(asset string) string {
+	extension := strings.ToLower(path.Ext(asset))
+	if mimeType, ok := allowedGameFileTypes[extension]; ok {
+		return mimeType
+	}
+	if mimeType := mime.TypeByExtension(extension); mimeType != "" {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
+
+/**
+ * loadManifestV2 returns a release's stored v2 manifest, generating it from disk
+ * for releases registered before manifests were stored
+ * Listed assets missing on disk are an error rather than being left out
+ */
+func loadManifestV2(manifestPath string, storedManifest string) (*GameManifestV2, error) {
+	resolvedPath, baseUrl, ok := ResolveManifestPath(manifestPath)
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusNotFound, "Manifest file not found")
+	}
+
+	var manifest GameManifestV2
+	if storedManifest != "" {
+		if err := json.Unmarshal([]byte(storedManifest), &manifest); err != nil {
+			return nil, err
+		}
+	} else {
+		pkg, err := ScanGamePackage(filepath.Dir(resolvedPath))
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Manifest file not found")
+		}
+		if len(pkg.MissingAssets) > 0 {
+			log.Printf("Release %s lists assets missing on disk: %s", manifestPath, strings.Join(pkg.MissingAssets, ", "))
+			return nil, fiber.NewError(fiber.StatusInternalServerError, "Game release is missing assets: "+strings.Join(pkg.MissingAssets, ", "))
+		}
+		manifest = BuildManifestV2(pkg)
+	}
+
+	manifest.BaseUrl = baseUrl
+	return &manifest, nil
+}
+
+/**
+ * sendWithETag responds with body, or 304 Not Modified when the client already has it
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {string} etag - Quoted entity tag, or empty to skip revalidation
+ * @param {interface{}} body - Value to send as JSON
+ * @returns {error} Error if any
+ */
+func sendWithETag(c *fiber.Ctx, etag string, body interface{}) error {
+	c.Set("Cache-Control", "no-cache")
+	if etag != "" {
+		c.Set("ETag", etag)
+		if etagMatches(c.Get("If-None-Match"), etag) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+	}
+	return c.JSON(body)
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * ManifestDelta lists what changed between two releases of a game
+ * Unchanged assets are still listed by path, because each release is served
+ * from its own versioned URL and clients must re-key what they already have
+ */
+type ManifestDelta struct {
+	SchemaVersion   int             `json:"schemaVersion"`
+	FromVersion     string          `json:"fromVersion"`
+	Version         string          `json:"version"`
+	EntryPoint      string          `json:"entryPoint"`
+	BaseUrl         string          `json:"baseUrl"`
+	PreviousBaseUrl string          `json:"previousBaseUrl"`
+	ContentHash     string          `json:"contentHash"`
+	TotalSize       int64           `json:"totalSize"`
+	DownloadSize    int64           `json:"downloadSize"`
+	Added           []ManifestAsset `json:"added"`
+	Changed         []ManifestAsset `json:"changed"`
+	Removed         []ManifestAsset `json:"removed"`
+	Unchanged       []string        `json:"unchanged"`
+	AssetQuery      string          `json:"assetQuery,omitempty"`
+	UrlsExpireAt    string          `json:"urlsExpireAt,omitempty"`
+}
+
+/**
+ * DiffManifests compares two v2 manifests asset by asset using their hashes
+ * @param {*GameManifestV2} from - Manifest the client already has
+ * @param {*GameManifestV2} to - Manifest to update to
+ * @returns {ManifestDelta} Added, changed, removed and unchanged assets
+ */
+func DiffManifests(from *GameManifestV2, to *GameManifestV2) ManifestDelta {
+	delta := ManifestDelta{
+		SchemaVersion:   2,
+		FromVersion:     from.Version,
+		Version:         to.Version,
+		EntryPoint:      to.EntryPoint,
+		BaseUrl:         to.BaseUrl,
+		PreviousBaseUrl: from.BaseUrl,
+		ContentHash:     to.ContentHash,
+		TotalSize:       to.TotalSize,
+		Added:           []ManifestAsset{},
+		Changed:         []ManifestAsset{},
+		Removed:         []ManifestAsset{},
+		Unchanged:       []string{},
+	}
+
+	previous := map[string]ManifestAsset{}
+	for _, asset := range from.Assets {
+		previous[asset.Path] = asset
+	}
+
+	for _, asset := range to.Assets {
+		old, existed := previous[asset.Path]
+		delete(previous, asset.Path)
+		switch {
+		case !existed:
+			delta.Added = append(delta.Added, asset)
+			delta.DownloadSize += asset.Size
+		case old.Sha256 != asset.Sha256:
+			delta.Changed = append(delta.Changed, asset)
+			delta.DownloadSize += asset.Size
+		default:
+			delta.Unchanged = append(delta.Unchanged, asset.Path)
+		}
+	}
+
+	// Keep removals in the order the old manifest listed them
+	for _, asset := range from.Assets {
+		if _, removed := previous[asset.Path]; removed {
+			delta.Removed = append(delta.Removed, asset)
+		}
+	}
+	return delta
+}
+
+/**
+ * sendManifestDelta responds with the changes between a previously published
+ * release and the live one, for GET /games/:slug/manifest?from=<version>
+ */
+func sendManifestDelta(c *fiber.Ctx, db *sql.DB, game Game, userId string, storedManifest string, fromVersion string) error {
+	var fromManifestPath, fromStoredManifest string
+	err := db.QueryRow(`
+		SELECT manifestPath, COALESCE(manifestJson, '') FROM game_releases
+		WHERE gameId = ? AND version = ? AND status != ?
+	`, game.Id, fromVersion, ReleaseDraft).Scan(&fromManifestPath, &fromStoredManifest)
+	if err == sql.ErrNoRows {
+		return ErrorResponse(c, 404, "Release "+fromVersion+" not found")
+	}
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	to, err := loadManifestV2(game.ManifestPath, storedManifest)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Could not load manifest")
+	}
+	from, err := loadManifestV2(fromManifestPath, fromStoredManifest)
+	if err != nil {
+		return FiberErrorResponse(c, err, "Could not load manifest")
+	}
+
+	delta := DiffManifests(from, to)
+	if !gameNeedsSignedUrls(game) {
+		return sendWithETag(c, `"`+to.ContentHash+`-from-`+from.ContentHash+`"`, delta)
+	}
+
+	query, expiresAt := SignedAssetQuery(userId, delta.BaseUrl)
+	delta.AssetQuery = query
+	delta.UrlsExpireAt = expiresAt.Format(time.RFC3339)
+	signAssetUrls(delta.Added, delta.BaseUrl, query)
+	signAssetUrls(delta.Changed, delta.BaseUrl, query)
+	return sendWithETag(c, "", delta)
+}
+
+/**
+ * signManifestUrls gives every asset of a gated game's manifest a signed, expiring URL
+ * Signed manifests go without an ETag, since a revalidated copy would carry expired URLs
+ */
+func signManifestUrls(manifest *GameManifestV2, userId string) {
+	query, expiresAt := SignedAssetQuery(userId, manifest.BaseUrl)
+	manifest.AssetQuery = query
+	manifest.UrlsExpireAt = expiresAt.Format(time.RFC3339)
+	signAssetUrls(manifest.Assets, manifest.BaseUrl, query)
+}
+
+func signAssetUrls(assets []ManifestAsset, baseUrl string, query string) {
+	for i := range assets {
+		assets[i].Url = baseUrl + assets[i].Path + query
+	}
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CurrentManifestVersion is the newest manifest.json schema this server understands
+// Version 1 (or no manifestVersion) is decoded leniently; version 2 rejects unknown fields
+const CurrentManifestVersion = 2
+
+// EngineVersion is the version of the game player and its postMessage API that games build against
+// Games needing a newer player set minEngineVersion and are refused until the server catches up
+const EngineVersion = "1.0.0"
+
+// Engine versions are plain MAJOR.MINOR.PATCH semantic versions
+var engineVersionPattern = regexp.MustCompile(`^(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)$`)
+
+var (
+	manifestOrientations    = []string{"any", "landscape", "portrait"}
+	manifestInputMethods    = []string{"touch", "keyboard", "mouse", "gamepad"}
+	manifestFeatures        = []string{"webgl", "webgl2", "webaudio", "wasm", "fullscreen", "pointerlock"}
+	progressionCapabilities = []string{"coins", "xp", "achievements", "unlockedItems", "cloudSaves"}
+)
+
+/**
+ * ManifestValidationError lists every problem found in a manifest.json
+ */
+type ManifestValidationError struct {
+	Problems []string
+}
+
+func (err *ManifestValidationError) Error() string {
+	return strings.Join(err.Problems, "; ")
+}
+
+/**
+ * ParseGameManifest decodes and validates a manifest.json
+ * @param {[]byte} data - File contents
+ * @returns {GameManifest} Decoded manifest
+ * @returns {error} A *ManifestValidationError listing every problem, or a JSON syntax error
+ */
+func ParseGameManifest(data []byte) (GameManifest, error) {
+	var manifest GameManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, err
+	}
+
+	problems := []string{}
+	if manifest.ManifestVersion > CurrentManifestVersion || manifest.ManifestVersion < 0 {
+		problems = append(problems, fmt.Sprintf("manifestVersion %d is not supported (newest is %d)", manifest.ManifestVersion, CurrentManifestVersion))
+		return manifest, &ManifestValidationError{Problems: problems}
+	}
+	if manifest.ManifestVersion >= 2 {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&GameManifest{}); err != nil {
+			problems = append(problems, strings.TrimPrefix(err.Error(), "json: "))
+		}
+	}
+
+	if manifest.Version == "" {
+		problems = append(problems, "version is required")
+	}
+	if manifest.EntryPoint == "" {
+		problems = append(problems, "entryPoint is required")
+	} else if !isPackagePath(manifest.EntryPoint) {
+		problems = append(problems, "entryPoint must be a relative path inside the package")
+	}
+	if manifest.MinEngineVersion != "" {
+		if !engineVersionPattern.MatchString(manifest.MinEngineVersion) {
+			problems = append(problems, "minEngineVersion must be a MAJOR.MINOR.PATCH version, e.g. 1.0.0")
+		} else if compareEngineVersions(manifest.MinEngineVersion, EngineVersion) > 0 {
+			problems = append(problems, fmt.Sprintf("minEngineVersion %s is newer than this server's game player (%s)", manifest.MinEngineVersion, EngineVersion))
+		}
+	}
+	if manifest.TotalSize < 0 {
+		problems = append(problems, "totalSize cannot be negative")
+	}
+	if manifest.LastUpdated != "" {
+		if _, err := time.Parse(time.RFC3339, manifest.LastUpdated); err != nil {
+			problems = append(problems, "lastUpdated must be an RFC 3339 timestamp")
+		}
+	}
+
+	seenAssets := map[string]bool{}
+	for _, asset := range manifest.Assets {
+		switch {
+		case !isPackagePath(asset):
+			problems = append(problems, fmt.Sprintf("asset %q must be a relative path inside the package", asset))
+		case seenAssets[asset]:
+			problems = append(problems, fmt.Sprintf("asset %q is listed more than once", asset))
+		}
+		seenAssets[asset] = true
+	}
+
+	if manifest.Orientation != "" && !containsString(manifestOrientations, manifest.Orientation) {
+		problems = append(problems, "orientation must be one of "+strings.Join(manifestOrientations, ", "))
+	}
+	problems = append(problems, checkManifestList("inputMethods", manifest.InputMethods, manifestInputMethods)...)
+	problems = append(problems, checkManifestList("requiredFeatures", manifest.RequiredFeatures, manifestFeatures)...)
+	problems = append(problems, checkManifestList("progression", manifest.Progression, progressionCapabilities)...)
+	problems = append(problems, checkEarningLimits(manifest.EarningLimits)...)
+	problems = append(problems, checkManifestAchievements(manifest.Achievements, seenAssets)...)
+	if _, ok := ratingHierarchy[manifest.ContentRating]; manifest.ContentRating != "" && !ok {
+		problems = append(problems, "contentRating must be one of everyone, everyone10, teen, mature")
+	}
+
+	for _, image := range append([]string{manifest.Thumbnail}, manifest.Screenshots...) {
+		// Listing images as assets gets them hashed, checked on disk and cached offline
+		if image != "" && !seenAssets[image] {
+			problems = append(problems, fmt.Sprintf("image %q must also be listed in assets", image))
+		}
+	}
+
+	if len(problems) > 0 {
+		return manifest, &ManifestValidationError{Problems: problems}
+	}
+	return manifest, nil
+}
+
+func checkManifestList(field string, values []string, allowed []string) []string {
+	problems := []string{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		if !containsString(allowed, value) {
+			problems = append(problems, fmt.Sprintf("%s: unknown value %q (allowed: %s)", field, value, strings.Join(allowed, ", ")))
+		} else if seen[value] {
+			problems = append(problems, fmt.Sprintf("%s: %q is listed more than once", field, value))
+		}
+		seen[value] = true
+	}
+	return problems
+}
+
+/**
+ * compareEngineVersions orders two versions that match engineVersionPattern
+ * @param {string} a - First version
+ * @param {string} b - Second version
+ * @returns {int} -1 if a is older than b, 1 if it is newer, 0 if they are the same
+ */
+func compareEngineVersions(a string, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := range aParts {
+		aPart, _ := strconv.Atoi(aParts[i])
+		bPart, _ := strconv.Atoi(bParts[i])
+		if aPart != bPart {
+			if aPart < bPart {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func isPackagePath(assetPath string) bool {
+	_, ok := resolveAssetPath(".", assetPath)
+	return ok
+}
@@ -1,14 +1,15 @@
 package api
 
 import (
+	"database/sql"
 	"fmt"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v4"
+	"io"
 	"log"
 )
 
 /**
- * AuthMiddleware checks for a valid JWT in the Authorization header
+ * AuthMiddleware checks for a valid access token in the Authorization header
  * @param {*fiber.Ctx} c - Fiber context
  * @returns {error} Error if any
  */
@@ -18,26 +19,82 @@ func AuthMiddleware(c *fiber.Ctx) error {
 		return ErrorResponse(c, fiber.StatusUnauthorized, "Missing token")
 	}
 
-	tokenString := authHeader
-	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-		tokenString = authHeader[7:]
+	userId := userIdFromToken(bearerToken(authHeader))
+	if userId == "" {
+		return ErrorResponse(c, fiber.StatusUnauthorized, "Invalid token")
+	}
+
+	c.Locals("userId", userId)
+	return c.Next()
+}
+
+/**
+ * AdminMiddleware only lets through users flagged as admins
+ * Must run after AuthMiddleware
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func AdminMiddleware(c *fiber.Ctx, db *sql.DB) error {
+	userId, _ := c.Locals("userId").(string)
+
+	var isAdmin int
+	err := db.QueryRow("SELECT isAdmin FROM users WHERE id = ? AND isDeleted=0", userId).Scan(&isAdmin)
+	if err != nil || isAdmin != 1 {
+		return ErrorResponse(c, fiber.StatusForbidden, "Admin access required")
 	}
+	return c.Next()
+}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fiber.ErrUnauthorized
+/**
+ * BodyLimit rejects request bodies larger than limit before any handler reads them
+ * The server streams request bodies instead of buffering them, so this is what enforces the size limits
+ * @param {int} limit - Largest body allowed, in bytes
+ * @param {func(*fiber.Ctx) bool} skip - Requests it returns true for are left to a later limit; may be nil
+ * @returns {fiber.Handler} Middleware
+ */
+func BodyLimit(limit int, skip func(c *fiber.Ctx) bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if skip != nil && skip(c) {
+			return c.Next()
 		}
-		return SecretKey, nil
-	})
 
-	if err != nil || !token.Valid {
-		return ErrorResponse(c, fiber.StatusUnauthorized, "Invalid token")
+		length := c.Request().Header.ContentLength()
+		if length > limit {
+			return ErrorResponse(c, fiber.StatusRequestEntityTooLarge, "Request body is too large")
+		}
+		// Chunked bodies have no declared length, so read them here, stopping one byte past the limit
+		if length == -1 {
+			body, err := io.ReadAll(io.LimitReader(c.Request().BodyStream(), int64(limit)+1))
+			if err != nil {
+				return ErrorResponse(c, fiber.StatusBadRequest, "Could not read request body")
+			}
+			if len(body) > limit {
+				return ErrorResponse(c, fiber.StatusRequestEntityTooLarge, "Request body is too large")
+			}
+			c.Request().SetBody(body)
+		}
+		return c.Next()
 	}
+}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		c.Locals("userId", claims["id"])
+/**
+ * RequireContentLength rejects request bodies that do not declare a length, or declare more than limit
+ * Use it instead of BodyLimit on routes whose limit is too large to buffer a chunked body in memory
+ * @param {int} limit - Largest body allowed, in bytes
+ * @returns {fiber.Handler} Middleware
+ */
+func RequireContentLength(limit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		length := c.Request().Header.ContentLength()
+		if length == -1 {
+			return ErrorResponse(c, fiber.StatusLengthRequired, "Content-Length header is required")
+		}
+		if length > limit {
+			return ErrorResponse(c, fiber.StatusRequestEntityTooLarge, "Request body is too large")
+		}
+		return c.Next()
 	}
-	return c.Next()
 }
 
 /**
@@ -73,3 +130,18 @@ func ErrorResponse(c *fiber.Ctx, status int, message string) error {
 		"error": message,
 	})
 }
+
+/**
+ * FiberErrorResponse responds with the status and message of a *fiber.Error,
+ * or logs any other error as a 500 with the given message
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {error} err - Error returned by a helper
+ * @param {string} message - Message used for unexpected errors
+ * @returns {error} Fiber error
+ */
+func FiberErrorResponse(c *fiber.Ctx, err error, message string) error {
+	if fiberErr, ok := err.(*fiber.Error); ok {
+		return ErrorResponse(c, fiberErr.Code, fiberErr.Message)
+	}
+	return StandardErrorResponse(c, 500, message, err)
+}
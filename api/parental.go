@@ -0,0 +1,575 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"time"
+)
+
+/**
+ * ParentalControls holds the restrictions a parent has placed on a child account
+ * DailyMinutes of 0 means no daily limit; allowed hours are [start, end) in the child's timezone
+ */
+type ParentalControls struct {
+	UserId           string   `json:"userId"`
+	ParentUserId     string   `json:"parentUserId"`
+	MaxRating        string   `json:"maxRating"`
+	AllowedGames     []string `json:"allowedGames"`
+	BlockedGames     []string `json:"blockedGames"`
+	DailyMinutes     int      `json:"dailyMinutes"`
+	AllowedStartHour int      `json:"allowedStartHour"`
+	AllowedEndHour   int      `json:"allowedEndHour"`
+	Timezone         string   `json:"timezone"`
+	UpdatedAt        string   `json:"updatedAt,omitempty"`
+}
+
+/**
+ * PlaySessionReport is a client's running total for one play session
+ * Seconds is cumulative for the session, so replaying a report is harmless
+ */
+type PlaySessionReport struct {
+	SessionId string `json:"sessionId"`
+	GameSlug  string `json:"gameSlug"`
+	StartedAt string `json:"startedAt"`
+	Seconds   int    `json:"seconds"`
+}
+
+/**
+ * PlayHeartbeatRequest carries the active session plus any sessions played offline
+ */
+type PlayHeartbeatRequest struct {
+	Sessions []PlaySessionReport `json:"sessions"`
+}
+
+/**
+ * PlayTimeStatus tells the game player whether the child may keep playing
+ * RemainingSeconds is null when no daily limit applies
+ */
+type PlayTimeStatus struct {
+	Allowed          bool   `json:"allowed"`
+	Reason           string `json:"reason,omitempty"`
+	UsedSeconds      int    `json:"usedSeconds"`
+	RemainingSeconds *int   `json:"remainingSeconds"`
+}
+
+// heartbeatClockSlack absorbs small clock differences between device and server
+const heartbeatClockSlack = 2 * time.Minute
+
+var ratingHierarchy = map[string]int{"everyone": 0, "everyone10": 1, "teen": 2, "mature": 3}
+
+/**
+ * CanAccessRating checks a game's content rating against a maximum allowed rating
+ * @param {string} maxRating - Highest rating the user may play
+ * @param {string} rating - Rating of the game
+ * @returns {bool} True if the rating is within the limit
+ */
+func CanAccessRating(maxRating string, rating string) bool {
+	maxLevel, maxExists := ratingHierarchy[maxRating]
+	level, exists := ratingHierarchy[rating]
+	if !maxExists || !exists {
+		return false
+	}
+	return level <= maxLevel
+}
+
+/**
+ * GetParentalControls loads the controls for a user
+ * @param {*sql.DB} db - Database connection
+ * @param {string} userId - User ID
+ * @returns {*ParentalControls, error} - Controls (nil when the user is unrestricted) and error if any
+ */
+func GetParentalControls(db *sql.DB, userId string) (*ParentalControls, error) {
+	if userId == "" {
+		return nil, nil
+	}
+
+	var controls ParentalControls
+	var allowedJSON, blockedJSON string
+	err := db.QueryRow(`
+		SELECT userId, parentUserId, maxRating, allowedGames, blockedGames, dailyMinutes, allowedStartHour, allowedEndHour, timezone, updatedAt
+		FROM parental_controls
+		WHERE userId = ?
+	`, userId).Scan(&controls.UserId, &controls.ParentUserId, &controls.MaxRating, &allowedJSON, &blockedJSON, &controls.DailyMinutes, &controls.AllowedStartHour, &controls.AllowedEndHour, &controls.Timezone, &controls.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(allowedJSON), &controls.AllowedGames); err != nil || controls.AllowedGames == nil {
+		controls.AllowedGames = []string{}
+	}
+	if err := json.Unmarshal([]byte(blockedJSON), &controls.BlockedGames); err != nil || controls.BlockedGames == nil {
+		controls.BlockedGames = []string{}
+	}
+
+	return &controls, nil
+}
+
+/**
+ * CheckParentalGameAccess applies the content rules (blocked list, allowed list, rating) to a game
+ * An explicitly allowed game bypasses the rating check; a blocked game is always refused
+ * @param {*ParentalControls} controls - Controls for the user, or nil
+ * @param {Game} game - Game to check
+ * @returns {bool, string} - Whether access is allowed and the reason if not
+ */
+func CheckParentalGameAccess(controls *ParentalControls, game Game) (bool, string) {
+	if controls == nil {
+		return true, ""
+	}
+	if containsString(controls.BlockedGames, game.Slug) {
+		return false, "Blocked by parental controls"
+	}
+	if containsString(controls.AllowedGames, game.Slug) {
+		return true, ""
+	}
+	if !CanAccessRating(controls.MaxRating, game.Rating) {
+		return false, "Content rating not allowed by parental controls: " + game.Rating
+	}
+	return true, ""
+}
+
+/**
+ * controlsLocation returns the timezone the controls are evaluated in, falling back to UTC
+ */
+func controlsLocation(controls *ParentalControls) *time.Location {
+	if controls == nil || controls.Timezone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(controls.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+/**
+ * isWithinAllowedHours checks the hour window, which may wrap past midnight (e.g. 20 to 8)
+ */
+func isWithinAllowedHours(controls *ParentalControls, now time.Time) bool {
+	start, end := controls.AllowedStartHour, controls.AllowedEndHour
+	if start == 0 && end == 24 {
+		return true
+	}
+	hour := now.In(controlsLocation(controls)).Hour()
+	if start < end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end
+}
+
+/**
+ * GetPlayTimeStatus works out whether a user may keep playing right now
+ * @param {*sql.DB} db - Database connection
+ * @param {string} userId - User ID
+ * @param {*ParentalControls} controls - Controls for the user, or nil
+ * @param {time.Time} now - Current time
+ * @returns {PlayTimeStatus, error} - Status and error if any
+ */
+func GetPlayTimeStatus(db *sql.DB, userId string, controls *ParentalControls, now time.Time) (PlayTimeStatus, error) {
+	playDate := now.In(controlsLocation(controls)).Format("2006-01-02")
+
+	var usedSeconds int
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(seconds), 0) FROM play_session_days
+		WHERE userId = ? AND playDate = ?
+	`, userId, playDate).Scan(&usedSeconds)
+	if err != nil {
+		return PlayTimeStatus{}, err
+	}
+
+	status := PlayTimeStatus{Allowed: true, UsedSeconds: usedSeconds}
+	if controls == nil {
+		return status, nil
+	}
+
+	if controls.DailyMinutes > 0 {
+		remaining := controls.DailyMinutes*60 - usedSeconds
+		if remaining < 0 {
+			remaining = 0
+		}
+		status.RemainingSeconds = &remaining
+		if remaining == 0 {
+			status.Allowed = false
+			status.Reason = "Daily play time used up"
+		}
+	}
+
+	if !isWithinAllowedHours(controls, now) {
+		status.Allowed = false
+		status.Reason = fmt.Sprintf("Play is only allowed between %02d:00 and %02d:00", controls.AllowedStartHour, controls.AllowedEndHour%24)
+	}
+
+	return status, nil
+}
+
+/**
+ * recordPlaySession stores a session report, crediting the seconds it adds to the server's current day
+ * Reports are clamped to wall-clock time so a device cannot claim more play than has elapsed,
+ * either since the session started or since its previous heartbeat
+ * @param {*sql.Tx} tx - The heartbeat's transaction
+ * @returns {error} A 400 fiber error for an invalid report, or a database error
+ */
+func recordPlaySession(tx *sql.Tx, userId string, report PlaySessionReport, location *time.Location, now time.Time) error {
+	if report.SessionId == "" || report.GameSlug == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "sessionId and gameSlug are required")
+	}
+	startedAt, err := time.Parse(time.RFC3339, report.StartedAt)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Invalid startedAt for session "+report.SessionId)
+	}
+	if startedAt.After(now) {
+		startedAt = now
+	}
+
+	var games int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM games WHERE slug = ?", report.GameSlug).Scan(&games); err != nil {
+		return err
+	}
+	if games == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Unknown game: "+report.GameSlug)
+	}
+
+	var owner string
+	var storedStartedAt, lastHeartbeatAt time.Time
+	var storedSeconds int
+	err = tx.QueryRow("SELECT userId, startedAt, seconds, lastHeartbeatAt FROM play_sessions WHERE id = ?", report.SessionId).
+		Scan(&owner, &storedStartedAt, &storedSeconds, &lastHeartbeatAt)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if exists && owner != userId {
+		return fiber.NewError(fiber.StatusBadRequest, "Session "+report.SessionId+" belongs to another user")
+	}
+	// Moving the start back would make room for play time the earlier heartbeats already ruled out
+	if exists && startedAt.Before(storedStartedAt) {
+		return fiber.NewError(fiber.StatusBadRequest, "startedAt for session "+report.SessionId+" is earlier than previously reported")
+	}
+	if exists {
+		startedAt = storedStartedAt
+	}
+
+	seconds := report.Seconds
+	maxSeconds := int((now.Sub(startedAt) + heartbeatClockSlack).Seconds())
+	if seconds > maxSeconds {
+		seconds = maxSeconds
+	}
+
+	credited := seconds - storedSeconds
+	if exists {
+		if sinceHeartbeat := int((now.Sub(lastHeartbeatAt) + heartbeatClockSlack).Seconds()); credited > sinceHeartbeat {
+			credited = sinceHeartbeat
+		}
+	}
+	if credited < 0 {
+		credited = 0
+	}
+
+	// Seconds count against the day the server received them, whatever day the device says the session started
+	playDate := now.In(location).Format("2006-01-02")
+
+	if exists {
+		_, err = tx.Exec("UPDATE play_sessions SET seconds = seconds + ?, lastHeartbeatAt = CURRENT_TIMESTAMP WHERE id = ?", credited, report.SessionId)
+	} else {
+		_, err = tx.Exec(`
+			INSERT INTO play_sessions(id, userId, gameSlug, playDate, startedAt, seconds, lastHeartbeatAt)
+			VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		`, report.SessionId, userId, report.GameSlug, playDate, startedAt.UTC(), credited)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO play_session_days(sessionId, userId, playDate, seconds) VALUES (?, ?, ?, ?)
+		ON CONFLICT(sessionId, playDate) DO UPDATE SET seconds = play_session_days.seconds + excluded.seconds
+	`, report.SessionId, userId, playDate, credited)
+	return err
+}
+
+/**
+ * PlaySessionHeartbeat records play time and tells the player whether to keep going
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func PlaySessionHeartbeat(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+
+	var heartbeat PlayHeartbeatRequest
+	if err := c.BodyParser(&heartbeat); err != nil {
+		return ErrorResponse(c, 400, "Invalid request body")
+	}
+
+	controls, err := GetParentalControls(db, userId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	now := time.Now().UTC()
+	location := controlsLocation(controls)
+
+	// Reports are recorded together, so one invalid report leaves none of the batch credited
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	for _, report := range heartbeat.Sessions {
+		if err := recordPlaySession(tx, userId, report, location, now); err != nil {
+			return FiberErrorResponse(c, err, "Database error")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	status, err := GetPlayTimeStatus(db, userId, controls, now)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	// The last report is the session currently running; stop it if the game has since been blocked
+	if status.Allowed && controls != nil && len(heartbeat.Sessions) > 0 {
+		current := heartbeat.Sessions[len(heartbeat.Sessions)-1]
+		var game Game
+		err := db.QueryRow(`SELECT slug, rating FROM games WHERE slug = ?`, current.GameSlug).Scan(&game.Slug, &game.Rating)
+		if err == nil {
+			if allowed, reason := CheckParentalGameAccess(controls, game); !allowed {
+				status.Allowed = false
+				status.Reason = reason
+			}
+		}
+	}
+
+	return c.JSON(status)
+}
+
+/**
+ * CreateChildAccount creates a child account owned by the current user
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func CreateChildAccount(c *fiber.Ctx, db *sql.DB) error {
+	parentUserId := c.Locals("userId").(string)
+
+	var parentOfParent sql.NullString
+	err := db.QueryRow("SELECT parentUserId FROM users WHERE id = ? AND isDeleted=0", parentUserId).Scan(&parentOfParent)
+	if err != nil {
+		return ErrorResponse(c, 404, "User not found")
+	}
+	if parentOfParent.Valid && parentOfParent.String != "" {
+		return ErrorResponse(c, 403, "Child accounts cannot create child accounts")
+	}
+
+	var user User
+	if err := c.BodyParser(&user); err != nil {
+		return ErrorResponse(c, 400, "Invalid request body")
+	}
+
+	if !ValidateEmail(user.Email) {
+		return ErrorResponse(c, 400, "Invalid email format")
+	}
+
+	valid, errorMsg := ValidatePasswordStrength(user.Password)
+	if !valid {
+		return ErrorResponse(c, 400, errorMsg)
+	}
+
+	if user.Password != user.ConfirmPassword {
+		return ErrorResponse(c, 400, "Passwords do not match")
+	}
+
+	var existingEmail string
+	err = db.QueryRow("SELECT email FROM users WHERE email = ? AND isDeleted=0", user.Email).Scan(&existingEmail)
+	if err == nil {
+		return ErrorResponse(c, 409, "Email already exists")
+	}
+
+	hashed, err := HashPassword(user.Password)
+	if err != nil {
+		return ErrorResponse(c, 500, "Failed to hash password")
+	}
+
+	user.Id = uuid.New().String()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO users(id, email, password, parentUserId) VALUES(?,?,?,?)", user.Id, user.Email, hashed, parentUserId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	// Child accounts start with the strictest rating until the parent says otherwise
+	_, err = tx.Exec("INSERT INTO parental_controls(userId, parentUserId) VALUES(?,?)", user.Id, parentUserId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	controls, err := GetParentalControls(db, user.Id)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	user.Password = ""
+	user.ConfirmPassword = ""
+	return c.Status(201).JSON(fiber.Map{"user": user, "controls": controls})
+}
+
+/**
+ * GetChildAccounts lists the current user's child accounts with their controls
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetChildAccounts(c *fiber.Ctx, db *sql.DB) error {
+	parentUserId := c.Locals("userId").(string)
+
+	rows, err := db.Query(`
+		SELECT id, email, createdDate, modifiedDate
+		FROM users
+		WHERE parentUserId = ? AND isDeleted=0
+		ORDER BY createdDate ASC
+	`, parentUserId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.Id, &user.Email, &user.CreatedDate, &user.ModifiedDate); err != nil {
+			rows.Close()
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+
+	children := []fiber.Map{}
+	for _, user := range users {
+		controls, err := GetParentalControls(db, user.Id)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		status, err := GetPlayTimeStatus(db, user.Id, controls, time.Now().UTC())
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		children = append(children, fiber.Map{"user": user, "controls": controls, "playTime": status})
+	}
+
+	return c.JSON(fiber.Map{"children": children})
+}
+
+/**
+ * UpdateChildControls updates the parental controls for one of the current user's children
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func UpdateChildControls(c *fiber.Ctx, db *sql.DB) error {
+	parentUserId := c.Locals("userId").(string)
+	childId := c.Params("id")
+
+	existing, err := GetParentalControls(db, childId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if existing == nil || existing.ParentUserId != parentUserId {
+		return ErrorResponse(c, 404, "Child account not found")
+	}
+
+	// Fields missing from the body keep their current values
+	controls := *existing
+	if err := c.BodyParser(&controls); err != nil {
+		return ErrorResponse(c, 400, "Invalid request body")
+	}
+
+	if _, ok := ratingHierarchy[controls.MaxRating]; !ok {
+		return ErrorResponse(c, 400, "Invalid maxRating")
+	}
+	if controls.DailyMinutes < 0 || controls.DailyMinutes > 24*60 {
+		return ErrorResponse(c, 400, "dailyMinutes must be between 0 and 1440")
+	}
+	if controls.AllowedStartHour < 0 || controls.AllowedStartHour > 23 || controls.AllowedEndHour < 1 || controls.AllowedEndHour > 24 || controls.AllowedStartHour == controls.AllowedEndHour {
+		return ErrorResponse(c, 400, "Allowed hours must satisfy 0 <= start <= 23, 1 <= end <= 24 and start != end")
+	}
+	if controls.Timezone == "" {
+		controls.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(controls.Timezone); err != nil {
+		return ErrorResponse(c, 400, "Invalid timezone")
+	}
+	if controls.AllowedGames == nil {
+		controls.AllowedGames = []string{}
+	}
+	if controls.BlockedGames == nil {
+		controls.BlockedGames = []string{}
+	}
+
+	allowedJSON, _ := json.Marshal(controls.AllowedGames)
+	blockedJSON, _ := json.Marshal(controls.BlockedGames)
+
+	_, err = db.Exec(`
+		UPDATE parental_controls SET
+			maxRating = ?, allowedGames = ?, blockedGames = ?, dailyMinutes = ?,
+			allowedStartHour = ?, allowedEndHour = ?, timezone = ?, updatedAt = CURRENT_TIMESTAMP
+		WHERE userId = ? AND parentUserId = ?
+	`, controls.MaxRating, string(allowedJSON), string(blockedJSON), controls.DailyMinutes, controls.AllowedStartHour, controls.AllowedEndHour, controls.Timezone, childId, parentUserId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Failed to update parental controls", err)
+	}
+
+	updated, err := GetParentalControls(db, childId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	return c.JSON(updated)
+}
+
+/**
+ * GetMyPlayTime returns the current user's play-time status for today
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetMyPlayTime(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+
+	controls, err := GetParentalControls(db, userId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	status, err := GetPlayTimeStatus(db, userId, controls, time.Now().UTC())
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	return c.JSON(fiber.Map{"playTime": status, "controls": controls})
+}
+
+func containsString(items []string, target string) bool {
+	for _, item := range items {
+		if item == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+/**
+ * precompressedEncodings lists the sibling files served in place of an asset,
+ * in order of preference, with the Content-Encoding each one is sent with
+ */
+var precompressedEncodings = []struct {
+	Encoding string
+	Suffix   string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// Images, audio, video and woff fonts are already compressed
+func isCompressibleType(mimeType string) bool {
+	switch {
+	case strings.HasPrefix(mimeType, "text/"):
+		return true
+	case mimeType == "application/json", mimeType == "application/xml", mimeType == "application/wasm",
+		mimeType == "image/svg+xml", mimeType == "image/x-icon", mimeType == "font/ttf", mimeType == "font/otf":
+		return true
+	}
+	return false
+}
+
+/**
+ * PrecompressGamePackage writes .br and .gz siblings next to a package's compressible assets
+ * Siblings newer than their asset are left alone, so running it again is cheap, and
+ * files that do not shrink are not compressed at all
+ * @param {string} packageDir - Directory holding the package's manifest.json
+ * @param {[]ManifestAsset} assets - Assets listed by the manifest
+ * @returns {int} Number of compressed files written
+ * @returns {error} Error if a file could not be read or written
+ */
+func PrecompressGamePackage(packageDir string, assets []ManifestAsset) (int, error) {
+	written := 0
+	for _, asset := range assets {
+		if !isCompressibleType(asset.MimeType) {
+			continue
+		}
+		assetPath, ok := resolveAssetPath(packageDir, asset.Path)
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(assetPath)
+		if err != nil {
+			return written, err
+		}
+
+		for _, encoding := range precompressedEncodings {
+			if sibling, err := os.Stat(assetPath + encoding.Suffix); err == nil && !sibling.ModTime().Before(info.ModTime()) {
+				continue
+			}
+			ok, err := compressFile(assetPath, info, encoding.Encoding, encoding.Suffix)
+			if err != nil {
+				return written, err
+			}
+			if ok {
+				written++
+			}
+		}
+	}
+	return written, nil
+}
+
+/**
+ * compressFile writes one compressed sibling through a temporary file, keeping it
+ * only if it is smaller than the original
+ */
+func compressFile(assetPath string, original os.FileInfo, encoding string, suffix string) (bool, error) {
+	source, err := os.Open(assetPath)
+	if err != nil {
+		return false, err
+	}
+	defer source.Close()
+
+	target, err := os.CreateTemp(filepath.Dir(assetPath), ".precompress-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(target.Name())
+	defer target.Close()
+
+	var writer io.WriteCloser
+	if encoding == "br" {
+		writer = brotli.NewWriterLevel(target, brotli.BestCompression)
+	} else {
+		writer, _ = gzip.NewWriterLevel(target, gzip.BestCompression)
+	}
+	if _, err := io.Copy(writer, source); err != nil {
+		return false, err
+	}
+	if err := writer.Close(); err != nil {
+		return false, err
+	}
+
+	info, err := target.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() >= original.Size() {
+		os.Remove(assetPath + suffix)
+		return false, nil
+	}
+	if err := target.Chmod(original.Mode().Perm()); err != nil {
+		return false, err
+	}
+	if err := target.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(target.Name(), assetPath+suffix)
+}
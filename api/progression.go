@@ -14,6 +14,11 @@ type UserProgression struct {
 	Achievements  []string `json:"achievements"`
 	UnlockedItems []string `json:"unlockedItems"`
 	LastSyncedAt  string   `json:"lastSyncedAt"`
+	// Derived from Xp and the level curve; NextLevelXp and XpToNextLevel are 0 at the top level
+	Level         int `json:"level"`
+	LevelXp       int `json:"levelXp"`
+	NextLevelXp   int `json:"nextLevelXp"`
+	XpToNextLevel int `json:"xpToNextLevel"`
 }
 
 type ProgressionSyncRequest struct {
@@ -22,6 +27,35 @@ type ProgressionSyncRequest struct {
 	NewAchievements    []string `json:"newAchievements"`
 	NewUnlockedItems   []string `json:"newUnlockedItems"`
 	ClientLastSyncedAt string   `json:"clientLastSyncedAt"`
+	// Game and play session the deltas were earned in, used to apply earning limits
+	GameSlug  string `json:"gameSlug"`
+	SessionId string `json:"sessionId"`
+	// Client-generated id for this batch of deltas, so a retried sync is only applied once
+	BatchId  string `json:"batchId"`
+	DeviceId string `json:"deviceId"`
+	// Increases with every batch the device sends; requires DeviceId and BatchId
+	Sequence int64 `json:"sequence"`
+	// Replaces the game's key/value state when set; requires GameSlug
+	State json.RawMessage `json:"state,omitempty"`
+}
+
+// ProgressionSyncResponse is the updated progression plus what the sync was allowed to award
+type ProgressionSyncResponse struct {
+	UserProgression
+	Accepted EarningResult `json:"accepted"`
+	// Progression in the game named by the request, if any
+	Game *GameProgression `json:"game,omitempty"`
+	// Achievements this sync unlocked, with the rewards that were granted for them
+	UnlockedAchievements []ManifestAchievement `json:"unlockedAchievements"`
+	// Levels this sync reached, with the rewards that were granted for them
+	LevelUps []LevelDefinition `json:"levelUps"`
+	// Set when the batch had already been applied and this is the original result
+	Replayed bool `json:"replayed,omitempty"`
+	// Set when the device had already sent a later batch; the deltas were applied but not the state
+	OutOfOrder bool `json:"outOfOrder,omitempty"`
+	// Changes to the progression since the device's last sync that the device did not make itself
+	Changes          []LedgerEntry `json:"changes,omitempty"`
+	ChangesTruncated bool          `json:"changesTruncated,omitempty"`
 }
 
 func GetProgression(c *fiber.Ctx, db *sql.DB) error {
@@ -43,6 +77,7 @@ func GetProgression(c *fiber.Ctx, db *sql.DB) error {
 		_, err = db.Exec(`
 			INSERT INTO user_progression(userId, coins, xp, achievements, unlockedItems, lastSyncedAt)
 			VALUES (?, 0, 0, '[]', '[]', CURRENT_TIMESTAMP)
+			ON CONFLICT(userId) DO NOTHING
 		`, userId)
 		if err != nil {
 			return StandardErrorResponse(c, 500, "Failed to initialize progression", err)
@@ -65,6 +100,12 @@ func GetProgression(c *fiber.Ctx, db *sql.DB) error {
 		progression.UnlockedItems = []string{}
 	}
 
+	curve, _, err := loadLevelCurve(db)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	progression.setLevel(curve)
+
 	return c.JSON(progression)
 }
 
@@ -75,11 +116,99 @@ func SyncProgression(c *fiber.Ctx, db *sql.DB) error {
 	if err := c.BodyParser(&syncReq); err != nil {
 		return ErrorResponse(c, 400, "Invalid request body")
 	}
+	if len(syncReq.BatchId) > maxSyncIdLength || len(syncReq.DeviceId) > maxSyncIdLength {
+		return ErrorResponse(c, 400, "batchId and deviceId must be at most 128 characters")
+	}
+	if syncReq.Sequence < 0 || (syncReq.Sequence > 0 && (syncReq.DeviceId == "" || syncReq.BatchId == "")) {
+		return ErrorResponse(c, 400, "sequence must be positive and requires deviceId and batchId")
+	}
+	if len(syncReq.State) > 0 && syncReq.GameSlug == "" {
+		return ErrorResponse(c, 400, "state requires gameSlug")
+	}
+	if !validateGameState(syncReq.State) {
+		return ErrorResponse(c, 400, "state must be a JSON object of at most 16KB")
+	}
+
+	// The connection uses BEGIN IMMEDIATE, so concurrent syncs for the same user
+	// (or retries of the same batch) are applied one after another
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	if syncReq.BatchId != "" {
+		original, err := findProgressionBatch(tx, userId, syncReq.BatchId)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		if original != nil {
+			return c.JSON(original)
+		}
+	}
+
+	var device syncDevice
+	var outOfOrder bool
+	if syncReq.DeviceId != "" {
+		if device, err = loadSyncDevice(tx, userId, syncReq.DeviceId); err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+	}
+	if syncReq.Sequence > 0 {
+		inUse, err := sequenceInUse(tx, userId, syncReq)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		if inUse {
+			return c.Status(409).JSON(fiber.Map{"error": "Stale batch: sequence already used by another batch from this device", "lastSequence": device.LastSequence})
+		}
+		// A batch that arrives after a later one still counts, but its state is older than what is stored
+		if syncReq.Sequence < device.LastSequence {
+			outOfOrder = true
+			syncReq.State = nil
+		}
+	}
+
+	result, err := applyProgressionSync(tx, userId, syncReq)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Failed to update progression", err)
+	}
+	result.OutOfOrder = outOfOrder
+
+	if syncReq.DeviceId != "" {
+		if result.Changes, result.ChangesTruncated, err = deviceChanges(tx, userId, syncReq.DeviceId, device); err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		if err := recordSyncDevice(tx, userId, syncReq); err != nil {
+			return StandardErrorResponse(c, 500, "Failed to record device", err)
+		}
+	}
+
+	if syncReq.BatchId != "" {
+		if err := recordProgressionBatch(tx, userId, syncReq, result); err != nil {
+			return StandardErrorResponse(c, 500, "Failed to record sync batch", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Failed to update progression", err)
+	}
 
+	return c.JSON(result)
+}
+
+/**
+ * applyProgressionSync adds a sync request's deltas to the user's progression
+ * @param {*sql.Tx} tx - Transaction holding the database write lock
+ * @param {string} userId - User ID
+ * @param {ProgressionSyncRequest} syncReq - Deltas the client reported
+ * @returns {ProgressionSyncResponse, error} Updated progression and error if any
+ */
+func applyProgressionSync(tx *sql.Tx, userId string, syncReq ProgressionSyncRequest) (ProgressionSyncResponse, error) {
 	var currentProgression UserProgression
 	var achievementsJSON, unlockedItemsJSON string
 
-	err := db.QueryRow(`
+	err := tx.QueryRow(`
 		SELECT userId, coins, xp, achievements, unlockedItems, lastSyncedAt
 		FROM user_progression
 		WHERE userId = ?
@@ -90,7 +219,7 @@ func SyncProgression(c *fiber.Ctx, db *sql.DB) error {
 		achievementsJSON = "[]"
 		unlockedItemsJSON = "[]"
 	} else if err != nil {
-		return StandardErrorResponse(c, 500, "Database error", err)
+		return ProgressionSyncResponse{}, err
 	}
 
 	if err := json.Unmarshal([]byte(achievementsJSON), &currentProgression.Achievements); err != nil {
@@ -100,8 +229,60 @@ func SyncProgression(c *fiber.Ctx, db *sql.DB) error {
 		currentProgression.UnlockedItems = []string{}
 	}
 
-	newCoins := currentProgression.Coins + syncReq.CoinsEarned
-	newXp := currentProgression.Xp + syncReq.XpEarned
+	earned, err := EvaluateEarnings(tx, userId, syncReq, time.Now())
+	if err != nil {
+		return ProgressionSyncResponse{}, err
+	}
+
+	// EvaluateEarnings has already refused every coin and XP of a sync naming an unknown game;
+	// such a game also has no per-game progression or achievements to update
+	var gameExists bool
+	var heldAchievements []string
+	if syncReq.GameSlug != "" {
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM games WHERE slug = ?)", syncReq.GameSlug).Scan(&gameExists); err != nil {
+			return ProgressionSyncResponse{}, err
+		}
+	}
+	if gameExists {
+		gameProgression, err := loadGameProgression(tx, userId, syncReq.GameSlug)
+		if err != nil {
+			return ProgressionSyncResponse{}, err
+		}
+		heldAchievements = gameProgression.Achievements
+	}
+
+	// Only achievements in the game's catalog can be unlocked, and each pays its reward once.
+	// A sync refused for its game or session unlocks nothing, as it earns no coins or XP either
+	unlocked := []ManifestAchievement{}
+	if earned.Rejected != "" {
+		for _, id := range newStrings(heldAchievements, syncReq.NewAchievements) {
+			earned.Adjustments = append(earned.Adjustments, EarningAdjustment{Field: "achievements", Kind: earned.Rejected, Item: id})
+		}
+	} else {
+		var unknown []string
+		unlocked, unknown, err = resolveAchievementUnlocks(tx, syncReq.GameSlug, syncReq.NewAchievements, heldAchievements)
+		if err != nil {
+			return ProgressionSyncResponse{}, err
+		}
+		for _, id := range unknown {
+			earned.Adjustments = append(earned.Adjustments, EarningAdjustment{Field: "achievements", Kind: AnomalyUnknownAchievement, Item: id})
+		}
+	}
+	syncReq.NewAchievements = []string{}
+	for _, achievement := range unlocked {
+		syncReq.NewAchievements = append(syncReq.NewAchievements, achievement.Id)
+	}
+	rewardEntries, rewardCoins, rewardXp := achievementRewardEntries(userId, syncReq, unlocked)
+
+	// Store items are only unlocked by buying them
+	allowedItems, storeItems, err := filterStoreItems(tx, syncReq.NewUnlockedItems)
+	if err != nil {
+		return ProgressionSyncResponse{}, err
+	}
+	for _, id := range storeItems {
+		earned.Adjustments = append(earned.Adjustments, EarningAdjustment{Field: "unlockedItems", Kind: AnomalyStoreItem, Item: id})
+	}
+	syncReq.NewUnlockedItems = allowedItems
 
 	mergedAchievements := mergeUniqueStrings(currentProgression.Achievements, syncReq.NewAchievements)
 	mergedUnlockedItems := mergeUniqueStrings(currentProgression.UnlockedItems, syncReq.NewUnlockedItems)
@@ -109,37 +290,63 @@ func SyncProgression(c *fiber.Ctx, db *sql.DB) error {
 	achievementsJSONBytes, _ := json.Marshal(mergedAchievements)
 	unlockedItemsJSONBytes, _ := json.Marshal(mergedUnlockedItems)
 
-	_, err = db.Exec(`
+	// Coins and XP are added in SQL so the stored totals never go back to a stale read
+	var newCoins, newXp int
+	err = tx.QueryRow(`
 		INSERT INTO user_progression(userId, coins, xp, achievements, unlockedItems, lastSyncedAt)
 		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
 		ON CONFLICT(userId) DO UPDATE SET
-			coins = excluded.coins,
-			xp = excluded.xp,
+			coins = user_progression.coins + excluded.coins,
+			xp = user_progression.xp + excluded.xp,
 			achievements = excluded.achievements,
 			unlockedItems = excluded.unlockedItems,
 			lastSyncedAt = excluded.lastSyncedAt
-	`, userId, newCoins, newXp, string(achievementsJSONBytes), string(unlockedItemsJSONBytes))
-
+		RETURNING coins, xp
+	`, userId, earned.CoinsEarned+rewardCoins, earned.XpEarned+rewardXp, string(achievementsJSONBytes), string(unlockedItemsJSONBytes)).Scan(&newCoins, &newXp)
 	if err != nil {
-		return StandardErrorResponse(c, 500, "Failed to update progression", err)
+		return ProgressionSyncResponse{}, err
 	}
 
-	result := UserProgression{UserId: userId, Coins: newCoins, Xp: newXp, Achievements: mergedAchievements, UnlockedItems: mergedUnlockedItems, LastSyncedAt: time.Now().UTC().Format(time.RFC3339)}
+	// Achievement rewards are recorded with the earnings, so they use up the limits of later syncs
+	recorded := earned
+	recorded.CoinsEarned += rewardCoins
+	recorded.XpEarned += rewardXp
+	if err := recordEarnings(tx, userId, syncReq, recorded); err != nil {
+		return ProgressionSyncResponse{}, err
+	}
+	if err := appendLedgerEntries(tx, append(syncLedgerEntries(userId, syncReq, earned, currentProgression), rewardEntries...)); err != nil {
+		return ProgressionSyncResponse{}, err
+	}
 
-	return c.JSON(result)
-}
+	result := ProgressionSyncResponse{
+		UserProgression:      UserProgression{UserId: userId, Coins: newCoins, Xp: newXp, Achievements: mergedAchievements, UnlockedItems: mergedUnlockedItems, LastSyncedAt: time.Now().UTC().Format(time.RFC3339)},
+		Accepted:             earned,
+		UnlockedAchievements: unlocked,
+	}
 
-func mergeUniqueStrings(existing []string, new []string) []string {
-	uniqueMap := make(map[string]bool)
-	for _, item := range existing {
-		uniqueMap[item] = true
+	curve, _, err := loadLevelCurve(tx)
+	if err != nil {
+		return ProgressionSyncResponse{}, err
 	}
-	for _, item := range new {
-		uniqueMap[item] = true
+	if result.LevelUps, err = applyLevelUps(tx, userId, syncReq, curve, currentProgression.Xp, &result.UserProgression); err != nil {
+		return ProgressionSyncResponse{}, err
 	}
-	result := make([]string, 0, len(uniqueMap))
-	for item := range uniqueMap {
-		result = append(result, item)
+	result.setLevel(curve)
+
+	if gameExists {
+		gameProgression, err := applyGameProgression(tx, userId, syncReq, earned.XpEarned+rewardXp)
+		if err != nil {
+			return ProgressionSyncResponse{}, err
+		}
+		result.Game = &gameProgression
 	}
-	return result
+
+	return result, nil
+}
+
+// mergeUniqueStrings keeps existing values in their order and appends the new ones in the order they were sent,
+// so achievements and items stay in unlock order on every device
+func mergeUniqueStrings(existing []string, new []string) []string {
+	merged := newStrings(nil, existing)
+	return append(merged, newStrings(merged, new)...)
 }
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+/**
+ * newSyncTestApp opens a fresh database with one user who has an hour of play time today,
+ * and an app that runs SyncProgression as that user
+ * @param {*testing.T} t - Test
+ * @returns {*fiber.App, *sql.DB, string} App, database and the user's ID
+ */
+func newSyncTestApp(t *testing.T) (*fiber.App, *sql.DB, string) {
+	t.Helper()
+	db := InitializeDatabase(filepath.Join(t.TempDir(), "test.db"))
+	t.Cleanup(func() { db.Close() })
+
+	userId := "sync-test-user"
+	if _, err := db.Exec("INSERT INTO users(id, email, password) VALUES (?, ?, ?)", userId, "sync@example.com", "x"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec(`
+		INSERT INTO play_sessions(id, userId, gameSlug, playDate, startedAt, seconds)
+		VALUES (?, ?, ?, date('now'), CURRENT_TIMESTAMP, ?)
+	`, "sync-test-session", userId, "plate-run", 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/progression/sync", func(c *fiber.Ctx) error {
+		c.Locals("userId", userId)
+		return SyncProgression(c, db)
+	})
+	return app, db, userId
+}
+
+/**
+ * postSync sends one sync request through the app
+ * @param {*fiber.App} app - App from newSyncTestApp
+ * @param {ProgressionSyncRequest} syncReq - Request body
+ * @returns {ProgressionSyncResponse, error} Response and error if the request failed
+ */
+func postSync(app *fiber.App, syncReq ProgressionSyncRequest) (ProgressionSyncResponse, error) {
+	var result ProgressionSyncResponse
+	body, _ := json.Marshal(syncReq)
+	req := httptest.NewRequest("POST", "/progression/sync", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return result, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return result, json.NewDecoder(resp.Body).Decode(&result)
+}
+
+func TestSyncProgressionConcurrentBatches(t *testing.T) {
+	app, db, userId := newSyncTestApp(t)
+
+	const batches, retries = 20, 10
+	errs := make(chan error, batches+retries)
+	replayed := make(chan ProgressionSyncResponse, retries)
+	var wg sync.WaitGroup
+
+	for i := 0; i < batches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := postSync(app, ProgressionSyncRequest{CoinsEarned: 5, XpEarned: 10, BatchId: fmt.Sprintf("batch-%d", i)})
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < retries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := postSync(app, ProgressionSyncRequest{CoinsEarned: 7, XpEarned: 3, BatchId: "retried-batch"})
+			errs <- err
+			if err == nil {
+				replayed <- result
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(replayed)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("sync failed: %v", err)
+		}
+	}
+	for result := range replayed {
+		if result.Accepted.CoinsEarned != 7 || result.Accepted.XpEarned != 3 {
+			t.Errorf("retry accepted %d coins and %d xp, want 7 and 3", result.Accepted.CoinsEarned, result.Accepted.XpEarned)
+		}
+	}
+
+	var coins, xp int
+	if err := db.QueryRow("SELECT coins, xp FROM user_progression WHERE userId = ?", userId).Scan(&coins, &xp); err != nil {
+		t.Fatal(err)
+	}
+	if wantCoins, wantXp := batches*5+7, batches*10+3; coins != wantCoins || xp != wantXp {
+		t.Errorf("progression has %d coins and %d xp, want %d and %d", coins, xp, wantCoins, wantXp)
+	}
+
+	var retriedRows, totalRows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM progression_events WHERE userId = ? AND batchId = ?", userId, "retried-batch").Scan(&retriedRows); err != nil {
+		t.Fatal(err)
+	}
+	if retriedRows != 1 {
+		t.Errorf("retried batch has %d progression_events rows, want 1", retriedRows)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM progression_events WHERE userId = ?", userId).Scan(&totalRows); err != nil {
+		t.Fatal(err)
+	}
+	if totalRows != batches+1 {
+		t.Errorf("found %d progression_events rows, want %d", totalRows, batches+1)
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/google/uuid"
+)
+
+// Batch and device ids are generated by clients, so keep them to a sane length
+const maxSyncIdLength = 128
+
+// A device that has been away longer than this gets its state back without the individual changes
+const maxDeviceChanges = 100
+
+/**
+ * syncDevice is what the server remembers about one of a user's devices
+ * LastLedgerId is the newest ledger entry the device was sent, either in a sync's
+ * progression or in its changes
+ */
+type syncDevice struct {
+	Known        bool
+	LastSequence int64
+	LastLedgerId int64
+}
+
+/**
+ * findProgressionBatch looks up a sync batch that was already applied
+ * @param {queryer} db - The sync's transaction
+ * @param {string} userId - User ID
+ * @param {string} batchId - Client-generated batch id
+ * @returns {*ProgressionSyncResponse} Original response if the batch was already applied, or nil
+ * @returns {error} Error if any
+ */
+func findProgressionBatch(db queryer, userId string, batchId string) (*ProgressionSyncResponse, error) {
+	var response sql.NullString
+	err := db.QueryRow("SELECT response FROM progression_events WHERE userId = ? AND batchId = ?", userId, batchId).Scan(&response)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var original ProgressionSyncResponse
+	if err := json.Unmarshal([]byte(response.String), &original); err != nil {
+		return nil, err
+	}
+	original.Replayed = true
+	return &original, nil
+}
+
+/**
+ * recordProgressionBatch stores an applied batch and its response so retries can be answered with it
+ */
+func recordProgressionBatch(db queryer, userId string, syncReq ProgressionSyncRequest, result ProgressionSyncResponse) error {
+	response, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO progression_events(id, userId, batchId, deviceId, sequence, gameSlug, sessionId, coinsEarned, xpEarned, response)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, uuid.New().String(), userId, syncReq.BatchId, syncReq.DeviceId, syncReq.Sequence, syncReq.GameSlug, syncReq.SessionId,
+		syncReq.CoinsEarned, syncReq.XpEarned, string(response))
+	return err
+}
+
+/**
+ * loadSyncDevice reads what the server knows about a device, or an unknown device if it never synced
+ * @param {queryer} db - The sync's transaction
+ * @param {string} userId - User ID
+ * @param {string} deviceId - Client-generated device id
+ * @returns {syncDevice, error} Device and error if any
+ */
+func loadSyncDevice(db queryer, userId string, deviceId string) (syncDevice, error) {
+	device := syncDevice{Known: true}
+	err := db.QueryRow(`
+		SELECT lastSequence, lastLedgerId FROM progression_devices WHERE userId = ? AND deviceId = ?
+	`, userId, deviceId).Scan(&device.LastSequence, &device.LastLedgerId)
+	if err == sql.ErrNoRows {
+		return syncDevice{}, nil
+	}
+	return device, err
+}
+
+/**
+ * sequenceInUse reports whether another batch from the device was already applied with this sequence number
+ * @param {queryer} db - The sync's transaction
+ * @param {string} userId - User ID
+ * @param {ProgressionSyncRequest} syncReq - Request carrying the device id, sequence and batch id
+ * @returns {bool, error} True if the sequence belongs to a different batch, and error if any
+ */
+func sequenceInUse(db queryer, userId string, syncReq ProgressionSyncRequest) (bool, error) {
+	var inUse bool
+	err := db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM progression_events WHERE userId = ? AND deviceId = ? AND sequence = ? AND batchId != ?)
+	`, userId, syncReq.DeviceId, syncReq.Sequence, syncReq.BatchId).Scan(&inUse)
+	return inUse, err
+}
+
+/**
+ * deviceChanges lists the ledger entries made since the device last synced by anything
+ * other than the device itself, such as other devices, store purchases or opening balances
+ * @param {queryer} db - The sync's transaction
+ * @param {string} userId - User ID
+ * @param {string} deviceId - Device that is syncing
+ * @param {syncDevice} device - What the server knew about the device before this sync
+ * @returns {[]LedgerEntry} Changes, oldest first
+ * @returns {bool} True if there were more than maxDeviceChanges and only the newest are listed
+ * @returns {error} Error if any
+ */
+func deviceChanges(db queryer, userId string, deviceId string, device syncDevice) ([]LedgerEntry, bool, error) {
+	changes := []LedgerEntry{}
+	// A new device starts from the authoritative state in the sync response
+	if !device.Known {
+		return changes, false, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT `+ledgerColumns+` FROM progression_ledger
+		WHERE userId = ? AND id > ? AND deviceId != ?
+		ORDER BY id DESC LIMIT ?
+	`, userId, device.LastLedgerId, deviceId, maxDeviceChanges+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanLedgerEntry(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		changes = append(changes, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	truncated := len(changes) > maxDeviceChanges
+	if truncated {
+		changes = changes[:maxDeviceChanges]
+	}
+	for i, j := 0, len(changes)-1; i < j; i, j = i+1, j-1 {
+		changes[i], changes[j] = changes[j], changes[i]
+	}
+	return changes, truncated, nil
+}
+
+/**
+ * recordSyncDevice remembers the device's highest sequence number and the newest ledger entry it has been sent
+ * @param {queryer} db - The sync's transaction
+ * @param {string} userId - User ID
+ * @param {ProgressionSyncRequest} syncReq - Request carrying the device id and sequence
+ * @returns {error} Error if any
+ */
+func recordSyncDevice(db queryer, userId string, syncReq ProgressionSyncRequest) error {
+	_, err := db.Exec(`
+		INSERT INTO progression_devices(userId, deviceId, lastSequence, lastLedgerId, lastSyncedAt)
+		VALUES (?, ?, ?, (SELECT COALESCE(MAX(id), 0) FROM progression_ledger WHERE userId = ?), CURRENT_TIMESTAMP)
+		ON CONFLICT(userId, deviceId) DO UPDATE SET
+			lastSequence = MAX(progression_devices.lastSequence, excluded.lastSequence),
+			lastLedgerId = excluded.lastLedgerId,
+			lastSyncedAt = excluded.lastSyncedAt
+	`, userId, syncReq.DeviceId, syncReq.Sequence, userId)
+	return err
+}
@@ -0,0 +1,365 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Kinds of progression_ledger entries; coins and xp carry an amount, the others an itemId
+const (
+	LedgerCoins       = "coins"
+	LedgerXp          = "xp"
+	LedgerAchievement = "achievement"
+	LedgerItem        = "item"
+)
+
+// Reasons recorded on progression_ledger entries
+const (
+	LedgerReasonSync           = "sync"
+	LedgerReasonOpeningBalance = "opening_balance"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+)
+
+/**
+ * LedgerEntry is one change to a user's progression
+ * Delta is the coin or XP amount, or +1 when an achievement or item was added
+ */
+type LedgerEntry struct {
+	Id              int64  `json:"id"`
+	UserId          string `json:"userId"`
+	GameSlug        string `json:"gameSlug,omitempty"`
+	DeviceId        string `json:"deviceId,omitempty"`
+	BatchId         string `json:"batchId,omitempty"`
+	Kind            string `json:"kind"`
+	ItemId          string `json:"itemId,omitempty"`
+	Delta           int    `json:"delta"`
+	Reason          string `json:"reason"`
+	ClientTimestamp string `json:"clientTimestamp,omitempty"`
+	CreatedAt       string `json:"createdAt"`
+}
+
+const ledgerColumns = "id, userId, gameSlug, deviceId, batchId, kind, itemId, delta, reason, clientTimestamp, createdAt"
+
+func scanLedgerEntry(row rowScanner) (LedgerEntry, error) {
+	var entry LedgerEntry
+	err := row.Scan(&entry.Id, &entry.UserId, &entry.GameSlug, &entry.DeviceId, &entry.BatchId, &entry.Kind,
+		&entry.ItemId, &entry.Delta, &entry.Reason, &entry.ClientTimestamp, &entry.CreatedAt)
+	return entry, err
+}
+
+/**
+ * ProgressionTotals are a user's balances, either as stored or as summed from the ledger
+ */
+type ProgressionTotals struct {
+	Coins         int      `json:"coins"`
+	Xp            int      `json:"xp"`
+	Achievements  []string `json:"achievements"`
+	UnlockedItems []string `json:"unlockedItems"`
+}
+
+/**
+ * appendLedgerEntries records the changes made by one progression update
+ * @param {queryer} db - The update's transaction
+ * @param {[]LedgerEntry} entries - Entries to append; UserId, Kind, Delta and Reason must be set
+ * @returns {error} Error if any
+ */
+func appendLedgerEntries(db queryer, entries []LedgerEntry) error {
+	for _, entry := range entries {
+		_, err := db.Exec(`
+			INSERT INTO progression_ledger(userId, gameSlug, deviceId, batchId, kind, itemId, delta, reason, clientTimestamp)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, entry.UserId, entry.GameSlug, entry.DeviceId, entry.BatchId, entry.Kind, entry.ItemId, entry.Delta, entry.Reason, entry.ClientTimestamp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * syncLedgerEntries lists the ledger entries for what a sync actually changed:
+ * the accepted coin and XP amounts, the achievements it unlocked in the game
+ * and any items that are new to the user
+ */
+func syncLedgerEntries(userId string, syncReq ProgressionSyncRequest, earned EarningResult, current UserProgression) []LedgerEntry {
+	base := LedgerEntry{
+		UserId:          userId,
+		GameSlug:        syncReq.GameSlug,
+		DeviceId:        syncReq.DeviceId,
+		BatchId:         syncReq.BatchId,
+		Reason:          LedgerReasonSync,
+		ClientTimestamp: syncReq.ClientLastSyncedAt,
+	}
+
+	entries := []LedgerEntry{}
+	add := func(kind string, itemId string, delta int) {
+		entry := base
+		entry.Kind, entry.ItemId, entry.Delta = kind, itemId, delta
+		entries = append(entries, entry)
+	}
+
+	if earned.CoinsEarned != 0 {
+		add(LedgerCoins, "", earned.CoinsEarned)
+	}
+	if earned.XpEarned != 0 {
+		add(LedgerXp, "", earned.XpEarned)
+	}
+	// NewAchievements has already been narrowed to catalog achievements new to this game
+	for _, achievement := range syncReq.NewAchievements {
+		add(LedgerAchievement, achievement, 1)
+	}
+	for _, item := range newStrings(current.UnlockedItems, syncReq.NewUnlockedItems) {
+		add(LedgerItem, item, 1)
+	}
+	return entries
+}
+
+// newStrings returns the values of added that are not in existing, without duplicates
+func newStrings(existing []string, added []string) []string {
+	seen := map[string]bool{}
+	for _, value := range existing {
+		seen[value] = true
+	}
+	result := []string{}
+	for _, value := range added {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+/**
+ * recordOpeningBalances gives users whose progression predates the ledger an opening
+ * balance entry per total, so their balances can be rebuilt from the ledger
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func recordOpeningBalances(db *sql.DB) error {
+	_, err := db.Exec(`
+		WITH unledgered AS (
+			SELECT * FROM user_progression
+			WHERE userId NOT IN (SELECT DISTINCT userId FROM progression_ledger)
+		)
+		INSERT INTO progression_ledger(userId, kind, itemId, delta, reason)
+		SELECT userId, 'coins', '', coins, ? FROM unledgered WHERE coins != 0
+		UNION ALL
+		SELECT userId, 'xp', '', xp, ? FROM unledgered WHERE xp != 0
+		UNION ALL
+		SELECT userId, 'achievement', value, 1, ? FROM unledgered, json_each(unledgered.achievements)
+		UNION ALL
+		SELECT userId, 'item', value, 1, ? FROM unledgered, json_each(unledgered.unlockedItems)
+	`, LedgerReasonOpeningBalance, LedgerReasonOpeningBalance, LedgerReasonOpeningBalance, LedgerReasonOpeningBalance)
+	return err
+}
+
+/**
+ * ledgerTotals sums a user's ledger into balances
+ * Achievements and items count as held while their deltas add up to more than zero
+ * @param {queryer} db - Database connection or transaction
+ * @param {string} userId - User ID
+ * @returns {ProgressionTotals, error} Totals and error if any
+ */
+func ledgerTotals(db queryer, userId string) (ProgressionTotals, error) {
+	totals := ProgressionTotals{Achievements: []string{}, UnlockedItems: []string{}}
+
+	rows, err := db.Query(`
+		SELECT kind, itemId, SUM(delta) FROM progression_ledger
+		WHERE userId = ?
+		GROUP BY kind, itemId
+		ORDER BY kind, MIN(id)
+	`, userId)
+	if err != nil {
+		return totals, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, itemId string
+		var sum int
+		if err := rows.Scan(&kind, &itemId, &sum); err != nil {
+			return totals, err
+		}
+		switch kind {
+		// Rewards carry the achievement they were for, so coins and XP span several groups
+		case LedgerCoins:
+			totals.Coins += sum
+		case LedgerXp:
+			totals.Xp += sum
+		case LedgerAchievement:
+			if sum > 0 {
+				totals.Achievements = append(totals.Achievements, itemId)
+			}
+		case LedgerItem:
+			if sum > 0 {
+				totals.UnlockedItems = append(totals.UnlockedItems, itemId)
+			}
+		}
+	}
+	return totals, rows.Err()
+}
+
+/**
+ * storedTotals reads a user's balances from user_progression
+ */
+func storedTotals(db queryer, userId string) (ProgressionTotals, error) {
+	totals := ProgressionTotals{Achievements: []string{}, UnlockedItems: []string{}}
+	var achievementsJSON, unlockedItemsJSON string
+	err := db.QueryRow("SELECT coins, xp, achievements, unlockedItems FROM user_progression WHERE userId = ?", userId).
+		Scan(&totals.Coins, &totals.Xp, &achievementsJSON, &unlockedItemsJSON)
+	if err == sql.ErrNoRows {
+		return totals, nil
+	}
+	if err != nil {
+		return totals, err
+	}
+	json.Unmarshal([]byte(achievementsJSON), &totals.Achievements)
+	json.Unmarshal([]byte(unlockedItemsJSON), &totals.UnlockedItems)
+	return totals, nil
+}
+
+/**
+ * GetProgressionHistory lists the current user's ledger entries, newest first
+ * Query parameters: limit (default 50, max 100), cursor (nextCursor of the previous page), gameSlug, kind
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetProgressionHistory(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+
+	limit := c.QueryInt("limit", defaultHistoryLimit)
+	if limit < 1 || limit > maxHistoryLimit {
+		return ErrorResponse(c, 400, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit))
+	}
+
+	query := "SELECT " + ledgerColumns + " FROM progression_ledger WHERE userId = ?"
+	args := []interface{}{userId}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		beforeId, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || beforeId < 1 {
+			return ErrorResponse(c, 400, "Invalid cursor")
+		}
+		query += " AND id < ?"
+		args = append(args, beforeId)
+	}
+	if gameSlug := c.Query("gameSlug"); gameSlug != "" {
+		query += " AND gameSlug = ?"
+		args = append(args, gameSlug)
+	}
+	if kind := c.Query("kind"); kind != "" {
+		query += " AND kind = ?"
+		args = append(args, kind)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer rows.Close()
+
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		entry, err := scanLedgerEntry(rows)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	response := fiber.Map{"entries": entries}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		response["entries"] = entries
+		response["nextCursor"] = strconv.FormatInt(entries[limit-1].Id, 10)
+	}
+	return c.JSON(response)
+}
+
+/**
+ * RecomputeProgression rebuilds a user's stored totals from the ledger (admin only)
+ * With ?dryRun=true it only reports whether the stored totals match the ledger
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func RecomputeProgression(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Params("id")
+	dryRun := c.QueryBool("dryRun", false)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	stored, err := storedTotals(tx, userId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	ledger, err := ledgerTotals(tx, userId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	matches := stored.Coins == ledger.Coins && stored.Xp == ledger.Xp &&
+		sameStringSet(stored.Achievements, ledger.Achievements) && sameStringSet(stored.UnlockedItems, ledger.UnlockedItems)
+
+	response := fiber.Map{"userId": userId, "stored": stored, "ledger": ledger, "matches": matches, "updated": false}
+	if matches || dryRun {
+		return c.JSON(response)
+	}
+
+	achievementsJSON, _ := json.Marshal(ledger.Achievements)
+	unlockedItemsJSON, _ := json.Marshal(ledger.UnlockedItems)
+	_, err = tx.Exec(`
+		INSERT INTO user_progression(userId, coins, xp, achievements, unlockedItems, lastSyncedAt)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(userId) DO UPDATE SET
+			coins = excluded.coins,
+			xp = excluded.xp,
+			achievements = excluded.achievements,
+			unlockedItems = excluded.unlockedItems,
+			lastSyncedAt = excluded.lastSyncedAt
+	`, userId, ledger.Coins, ledger.Xp, string(achievementsJSON), string(unlockedItemsJSON))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Failed to update progression", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Failed to update progression", err)
+	}
+
+	log.Printf("Admin %s recomputed progression for user %s: coins %d -> %d, xp %d -> %d",
+		c.Locals("userId").(string), userId, stored.Coins, ledger.Coins, stored.Xp, ledger.Xp)
+	response["updated"] = true
+	return c.JSON(response)
+}
+
+func sameStringSet(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sortedA := append([]string{}, a...)
+	sortedB := append([]string{}, b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
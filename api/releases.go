@@ -0,0 +1,274 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+/**
+ * GameRelease is one immutable uploaded version of a game
+ * Status is draft (never published), live (served to players) or retired (superseded)
+ */
+type GameRelease struct {
+	Id           string `json:"id"`
+	GameId       string `json:"gameId"`
+	Version      string `json:"version"`
+	Status       string `json:"status"`
+	ManifestPath string `json:"manifestPath"`
+	SizeBytes    int64  `json:"sizeBytes"`
+	ContentHash  string `json:"contentHash"`
+	CreatedAt    string `json:"createdAt"`
+	PublishedAt  string `json:"publishedAt,omitempty"`
+}
+
+const (
+	ReleaseDraft   = "draft"
+	ReleaseLive    = "live"
+	ReleaseRetired = "retired"
+)
+
+// Versions double as directory names, so keep them to a safe character set
+var versionPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+_-]{0,63}$`)
+
+/**
+ * ValidateVersion checks that a manifest version can be used as a release directory name
+ * @param {string} version - Version to validate
+ * @returns {bool} True if the version is valid
+ */
+func ValidateVersion(version string) bool {
+	return versionPattern.MatchString(version) && !strings.Contains(version, "..")
+}
+
+/**
+ * ResolveManifestPath maps a games.manifestPath value onto the games directory
+ * Paths that point outside it are rejected
+ * @param {string} manifestPath - Path stored in the database
+ * @returns {string} Filesystem path to the manifest
+ * @returns {string} URL the manifest's assets are served under, ending in a slash
+ * @returns {bool} False if the path is outside the games directory
+ */
+func ResolveManifestPath(manifestPath string) (string, string, bool) {
+	cleaned := filepath.Clean(filepath.FromSlash(manifestPath))
+	relative, err := filepath.Rel(GamesDir, cleaned)
+	if err != nil || relative == "." || strings.HasPrefix(relative, "..") {
+		return "", "", false
+	}
+	baseUrl := path.Join("/games", filepath.ToSlash(filepath.Dir(relative))) + "/"
+	return cleaned, baseUrl, true
+}
+
+func scanRelease(row rowScanner) (GameRelease, error) {
+	var release GameRelease
+	var publishedAt sql.NullString
+	err := row.Scan(&release.Id, &release.GameId, &release.Version, &release.Status, &release.ManifestPath,
+		&release.SizeBytes, &release.ContentHash, &release.CreatedAt, &publishedAt)
+	release.PublishedAt = publishedAt.String
+	return release, err
+}
+
+const releaseColumns = "id, gameId, version, status, manifestPath, sizeBytes, COALESCE(contentHash, ''), createdAt, publishedAt"
+
+/**
+ * createRelease records a new draft release for a scanned package,
+ * storing its generated v2 manifest alongside it
+ */
+func createRelease(tx *sql.Tx, gameId string, manifestPath string, pkg *GamePackage) (string, error) {
+	manifestJson, err := json.Marshal(BuildManifestV2(pkg))
+	if err != nil {
+		return "", err
+	}
+
+	releaseId := uuid.New().String()
+	_, err = tx.Exec(`
+		INSERT INTO game_releases(id, gameId, version, status, manifestPath, sizeBytes, contentHash, manifestJson)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, releaseId, gameId, pkg.Manifest.Version, ReleaseDraft, manifestPath, pkg.SizeBytes, pkg.ContentHash, string(manifestJson))
+	return releaseId, err
+}
+
+/**
+ * publishRelease makes a release live and points the games row at it
+ * The previously live release is retired so it stays available for rollback
+ */
+func publishRelease(tx *sql.Tx, gameId string, releaseId string) error {
+	_, err := tx.Exec(`
+		UPDATE game_releases SET status = ?
+		WHERE gameId = ? AND status = ? AND id != ?
+	`, ReleaseRetired, gameId, ReleaseLive, releaseId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE game_releases SET status = ?, publishedAt = CURRENT_TIMESTAMP
+		WHERE id = ? AND gameId = ?
+	`, ReleaseLive, releaseId, gameId)
+	if err != nil {
+		return err
+	}
+
+	return mirrorLiveRelease(tx, gameId, releaseId)
+}
+
+/**
+ * mirrorLiveRelease copies a release's version, path, size and hash onto the games
+ * row so the catalog can read them without a join, and loads its achievements
+ */
+func mirrorLiveRelease(tx *sql.Tx, gameId string, releaseId string) error {
+	_, err := tx.Exec(`
+		UPDATE games SET liveReleaseId = r.id, version = r.version, manifestPath = r.manifestPath,
+			sizeBytes = r.sizeBytes, contentHash = r.contentHash, updatedAt = CURRENT_TIMESTAMP
+		FROM (SELECT id, version, manifestPath, sizeBytes, contentHash FROM game_releases WHERE id = ?) AS r
+		WHERE games.id = ?
+	`, releaseId, gameId)
+	if err != nil {
+		return err
+	}
+	return syncAchievementCatalog(tx, gameId, releaseId)
+}
+
+/**
+ * findGameId looks up a game's id by slug, including retired games
+ */
+func findGameId(db *sql.DB, slug string) (string, error) {
+	var gameId string
+	err := db.QueryRow("SELECT id FROM games WHERE slug = ?", slug).Scan(&gameId)
+	if err == sql.ErrNoRows {
+		return "", fiber.NewError(fiber.StatusNotFound, "Game not found")
+	}
+	return gameId, err
+}
+
+/**
+ * GetGameReleases lists every release of a game, newest first (admin only)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetGameReleases(c *fiber.Ctx, db *sql.DB) error {
+	gameId, err := findGameId(db, c.Params("slug"))
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	rows, err := db.Query("SELECT "+releaseColumns+" FROM game_releases WHERE gameId = ? ORDER BY createdAt DESC, rowid DESC", gameId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer rows.Close()
+
+	releases := []GameRelease{}
+	for rows.Next() {
+		release, err := scanRelease(rows)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		releases = append(releases, release)
+	}
+
+	return c.JSON(fiber.Map{"releases": releases})
+}
+
+/**
+ * PublishGameRelease makes a specific version live (admin only)
+ * Publishing a retired release is how a rollback to that version is done
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func PublishGameRelease(c *fiber.Ctx, db *sql.DB) error {
+	gameId, err := findGameId(db, c.Params("slug"))
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	release, err := scanRelease(db.QueryRow("SELECT "+releaseColumns+" FROM game_releases WHERE gameId = ? AND version = ?", gameId, c.Params("version")))
+	if err == sql.ErrNoRows {
+		return ErrorResponse(c, 404, "Release not found")
+	}
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	return switchLiveRelease(c, db, gameId, release)
+}
+
+/**
+ * RollbackGameRelease makes the most recently live release that predates the
+ * current one live again (admin only); repeated calls keep stepping back
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func RollbackGameRelease(c *fiber.Ctx, db *sql.DB) error {
+	gameId, err := findGameId(db, c.Params("slug"))
+	if err != nil {
+		return FiberErrorResponse(c, err, "Database error")
+	}
+
+	// The previous release is the retired one published most recently before the live one went live;
+	// releases published within the same second fall back to upload order
+	release, err := scanRelease(db.QueryRow(`
+		SELECT `+releaseColumns+` FROM game_releases
+		WHERE gameId = ? AND status = ? AND publishedAt IS NOT NULL
+			AND publishedAt <= (SELECT publishedAt FROM game_releases WHERE gameId = ? AND status = ?)
+		ORDER BY publishedAt DESC, rowid DESC LIMIT 1
+	`, gameId, ReleaseRetired, gameId, ReleaseLive))
+	if err == sql.ErrNoRows {
+		return ErrorResponse(c, 409, "No previous release to roll back to")
+	}
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	return switchLiveRelease(c, db, gameId, release)
+}
+
+func switchLiveRelease(c *fiber.Ctx, db *sql.DB, gameId string, release GameRelease) error {
+	if release.Status == ReleaseLive {
+		return c.JSON(release)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	if err := publishRelease(tx, gameId, release.Id); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	release, err = scanRelease(db.QueryRow("SELECT "+releaseColumns+" FROM game_releases WHERE id = ?", release.Id))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	return c.JSON(release)
+}
+
+/**
+ * storeReleaseManifest saves the generated v2 manifest for a release registered without one,
+ * moving the release (and its game, if it is live) to the content hash that covers manifest.json
+ */
+func storeReleaseManifest(tx *sql.Tx, releaseId string, pkg *GamePackage) error {
+	manifestJson, err := json.Marshal(BuildManifestV2(pkg))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE game_releases SET manifestJson = ?, contentHash = ? WHERE id = ?", string(manifestJson), pkg.ContentHash, releaseId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE games SET contentHash = ? WHERE liveReleaseId = ?", pkg.ContentHash, releaseId)
+	return err
+}
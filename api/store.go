@@ -0,0 +1,446 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Store item ids are what ends up in unlockedItems, so they follow the same rules as achievement ids
+var storeItemIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]{0,63}$`)
+
+const (
+	LedgerReasonPurchase = "purchase"
+	AnomalyStoreItem     = "store_item"
+
+	defaultPurchaseHistoryLimit = 50
+	maxPurchaseHistoryLimit     = 100
+)
+
+/**
+ * StoreItem is an item players can buy with coins
+ * An empty GameSlug makes the item platform-wide. Stock, AvailableFrom and AvailableUntil
+ * limit how many can be sold and when; each is unlimited when left out
+ */
+type StoreItem struct {
+	Id             string `json:"id"`
+	Title          string `json:"title"`
+	Description    string `json:"description,omitempty"`
+	Price          int    `json:"price"`
+	TierRequired   string `json:"tierRequired"`
+	GameSlug       string `json:"gameSlug,omitempty"`
+	Stock          *int   `json:"stock,omitempty"`
+	Sold           int    `json:"sold"`
+	AvailableFrom  string `json:"availableFrom,omitempty"`
+	AvailableUntil string `json:"availableUntil,omitempty"`
+	Owned          bool   `json:"owned"`
+}
+
+// StorePurchase is one item a user bought, and what it cost them
+type StorePurchase struct {
+	Id        int64  `json:"id"`
+	ItemId    string `json:"itemId"`
+	GameSlug  string `json:"gameSlug,omitempty"`
+	Price     int    `json:"price"`
+	CreatedAt string `json:"createdAt"`
+}
+
+const storeItemColumns = "id, title, description, price, tierRequired, gameSlug, stock, sold, availableFrom, availableUntil"
+
+func scanStoreItem(row rowScanner) (StoreItem, error) {
+	var item StoreItem
+	var stock sql.NullInt64
+	err := row.Scan(&item.Id, &item.Title, &item.Description, &item.Price, &item.TierRequired, &item.GameSlug,
+		&stock, &item.Sold, &item.AvailableFrom, &item.AvailableUntil)
+	if stock.Valid {
+		total := int(stock.Int64)
+		item.Stock = &total
+	}
+	return item, err
+}
+
+/**
+ * availability explains why an item cannot be bought right now
+ * @param {time.Time} now - Current time
+ * @returns {string} Reason, or empty if the item is on sale
+ */
+func (item StoreItem) availability(now time.Time) string {
+	if from, err := time.Parse(time.RFC3339, item.AvailableFrom); err == nil && now.Before(from) {
+		return "Item is not on sale yet"
+	}
+	if until, err := time.Parse(time.RFC3339, item.AvailableUntil); err == nil && !now.Before(until) {
+		return "Item is no longer on sale"
+	}
+	if item.Stock != nil && item.Sold >= *item.Stock {
+		return "Item is sold out"
+	}
+	return ""
+}
+
+/**
+ * filterStoreItems drops store items from the items a sync reports as unlocked
+ * Store items can only be bought, so a client granting one to itself is flagged
+ * @param {queryer} db - The sync's transaction
+ * @param {[]string} items - Items the client reported
+ * @returns {[]string} Items that may be unlocked
+ * @returns {[]string} Store items that were dropped
+ * @returns {error} Error if any
+ */
+func filterStoreItems(db queryer, items []string) ([]string, []string, error) {
+	allowed := []string{}
+	dropped := []string{}
+	for _, item := range items {
+		var isStoreItem bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM store_items WHERE id = ?)", item).Scan(&isStoreItem); err != nil {
+			return nil, nil, err
+		}
+		if isStoreItem {
+			dropped = append(dropped, item)
+		} else {
+			allowed = append(allowed, item)
+		}
+	}
+	return allowed, dropped, nil
+}
+
+/**
+ * GetStoreItems lists the items currently on sale
+ * Signed-in users also see which items they already own
+ * Query params: gameSlug (only that game's items and platform-wide ones)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetStoreItems(c *fiber.Ctx, db *sql.DB) error {
+	owned := map[string]bool{}
+	if userId := GetOptionalUserId(c); userId != "" {
+		var unlockedItemsJSON string
+		err := db.QueryRow("SELECT unlockedItems FROM user_progression WHERE userId = ?", userId).Scan(&unlockedItemsJSON)
+		if err != nil && err != sql.ErrNoRows {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+		var unlockedItems []string
+		json.Unmarshal([]byte(unlockedItemsJSON), &unlockedItems)
+		for _, item := range unlockedItems {
+			owned[item] = true
+		}
+	}
+
+	query := "SELECT " + storeItemColumns + " FROM store_items WHERE retiredAt IS NULL"
+	args := []interface{}{}
+	if gameSlug := c.Query("gameSlug"); gameSlug != "" {
+		query += " AND gameSlug IN ('', ?)"
+		args = append(args, gameSlug)
+	}
+	query += " ORDER BY price, id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	items := []StoreItem{}
+	for rows.Next() {
+		item, err := scanStoreItem(rows)
+		if err != nil {
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		if item.availability(now) != "" {
+			continue
+		}
+		item.Owned = owned[item.Id]
+		items = append(items, item)
+	}
+
+	return c.JSON(fiber.Map{"items": items})
+}
+
+/**
+ * PurchaseStoreItem buys an item with the current user's coins
+ * The coins are debited and the item unlocked in one transaction; an item the user
+ * already owns is refused, so a retried purchase never charges twice
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func PurchaseStoreItem(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+
+	var purchaseReq struct {
+		ItemId string `json:"itemId"`
+	}
+	if err := c.BodyParser(&purchaseReq); err != nil || purchaseReq.ItemId == "" {
+		return ErrorResponse(c, 400, "itemId is required")
+	}
+	userTier := GetUserTier(db, userId)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer tx.Rollback()
+
+	item, err := scanStoreItem(tx.QueryRow("SELECT "+storeItemColumns+" FROM store_items WHERE id = ? AND retiredAt IS NULL", purchaseReq.ItemId))
+	if err == sql.ErrNoRows {
+		return ErrorResponse(c, 404, "Item not found")
+	}
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if reason := item.availability(time.Now()); reason != "" {
+		return ErrorResponse(c, 409, reason)
+	}
+	if !CanAccessTier(userTier, item.TierRequired) {
+		return ErrorResponse(c, 403, "Your subscription tier cannot buy this item")
+	}
+	// Items for a game can only be bought by users who may play it
+	if item.GameSlug != "" {
+		if _, _, _, err := findPlayableGame(db, item.GameSlug, userId); err != nil {
+			return FiberErrorResponse(c, err, "Database error")
+		}
+	}
+
+	// Users who never synced have no progression row yet, and so no coins
+	_, err = tx.Exec("INSERT INTO user_progression(userId) VALUES (?) ON CONFLICT(userId) DO NOTHING", userId)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	progression := UserProgression{UserId: userId}
+	var achievementsJSON, unlockedItemsJSON string
+	err = tx.QueryRow(`
+		SELECT coins, xp, achievements, unlockedItems, lastSyncedAt FROM user_progression WHERE userId = ?
+	`, userId).Scan(&progression.Coins, &progression.Xp, &achievementsJSON, &unlockedItemsJSON, &progression.LastSyncedAt)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	json.Unmarshal([]byte(achievementsJSON), &progression.Achievements)
+	json.Unmarshal([]byte(unlockedItemsJSON), &progression.UnlockedItems)
+	if progression.Achievements == nil {
+		progression.Achievements = []string{}
+	}
+	if progression.UnlockedItems == nil {
+		progression.UnlockedItems = []string{}
+	}
+
+	if containsString(progression.UnlockedItems, item.Id) {
+		return ErrorResponse(c, 409, "Item already owned")
+	}
+	if progression.Coins < item.Price {
+		return c.Status(402).JSON(fiber.Map{"error": "Insufficient coins", "price": item.Price, "coins": progression.Coins})
+	}
+
+	progression.UnlockedItems = append(progression.UnlockedItems, item.Id)
+	unlockedItemsBytes, _ := json.Marshal(progression.UnlockedItems)
+	err = tx.QueryRow(`
+		UPDATE user_progression SET coins = coins - ?, unlockedItems = ?
+		WHERE userId = ? AND coins >= ?
+		RETURNING coins
+	`, item.Price, string(unlockedItemsBytes), userId, item.Price).Scan(&progression.Coins)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Failed to debit coins", err)
+	}
+
+	if _, err := tx.Exec("UPDATE store_items SET sold = sold + 1 WHERE id = ?", item.Id); err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+
+	purchase := StorePurchase{ItemId: item.Id, GameSlug: item.GameSlug, Price: item.Price}
+	err = tx.QueryRow(`
+		INSERT INTO store_purchases(userId, itemId, gameSlug, price) VALUES (?, ?, ?, ?)
+		RETURNING id, createdAt
+	`, userId, item.Id, item.GameSlug, item.Price).Scan(&purchase.Id, &purchase.CreatedAt)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Failed to record purchase", err)
+	}
+
+	entry := LedgerEntry{UserId: userId, GameSlug: item.GameSlug, ItemId: item.Id, Reason: LedgerReasonPurchase}
+	entries := []LedgerEntry{}
+	if item.Price > 0 {
+		debit := entry
+		debit.Kind, debit.Delta = LedgerCoins, -item.Price
+		entries = append(entries, debit)
+	}
+	entry.Kind, entry.Delta = LedgerItem, 1
+	if err := appendLedgerEntries(tx, append(entries, entry)); err != nil {
+		return StandardErrorResponse(c, 500, "Failed to record purchase", err)
+	}
+
+	// Items scoped to a game also show up in that game's progression
+	if item.GameSlug != "" {
+		gameItem := ProgressionSyncRequest{GameSlug: item.GameSlug, NewUnlockedItems: []string{item.Id}}
+		if _, err := applyGameProgression(tx, userId, gameItem, 0); err != nil {
+			return StandardErrorResponse(c, 500, "Database error", err)
+		}
+	}
+
+	curve, _, err := loadLevelCurve(tx)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return StandardErrorResponse(c, 500, "Failed to record purchase", err)
+	}
+
+	progression.setLevel(curve)
+	return c.JSON(fiber.Map{"purchase": purchase, "progression": progression})
+}
+
+/**
+ * GetPurchaseHistory lists the current user's purchases, newest first
+ * Query params: limit (default 50, max 100), cursor (from the previous page's nextCursor)
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func GetPurchaseHistory(c *fiber.Ctx, db *sql.DB) error {
+	userId := c.Locals("userId").(string)
+
+	limit := c.QueryInt("limit", defaultPurchaseHistoryLimit)
+	if limit < 1 || limit > maxPurchaseHistoryLimit {
+		return ErrorResponse(c, 400, fmt.Sprintf("limit must be between 1 and %d", maxPurchaseHistoryLimit))
+	}
+
+	query := "SELECT id, itemId, gameSlug, price, createdAt FROM store_purchases WHERE userId = ?"
+	args := []interface{}{userId}
+	if cursor := c.Query("cursor"); cursor != "" {
+		beforeId, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || beforeId < 1 {
+			return ErrorResponse(c, 400, "Invalid cursor")
+		}
+		query += " AND id < ?"
+		args = append(args, beforeId)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	defer rows.Close()
+
+	purchases := []StorePurchase{}
+	for rows.Next() {
+		var purchase StorePurchase
+		if err := rows.Scan(&purchase.Id, &purchase.ItemId, &purchase.GameSlug, &purchase.Price, &purchase.CreatedAt); err != nil {
+			return StandardErrorResponse(c, 500, "Database scan error", err)
+		}
+		purchases = append(purchases, purchase)
+	}
+
+	response := fiber.Map{"purchases": purchases}
+	if len(purchases) > limit {
+		purchases = purchases[:limit]
+		response["purchases"] = purchases
+		response["nextCursor"] = strconv.FormatInt(purchases[limit-1].Id, 10)
+	}
+	return c.JSON(response)
+}
+
+/**
+ * SaveStoreItem creates or updates a store item (admin only)
+ * Updating an item does not change what earlier buyers paid or own
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func SaveStoreItem(c *fiber.Ctx, db *sql.DB) error {
+	var item StoreItem
+	if err := c.BodyParser(&item); err != nil {
+		return ErrorResponse(c, 400, "Invalid request body")
+	}
+	item.Id = c.Params("id")
+	if item.TierRequired == "" {
+		item.TierRequired = "free"
+	}
+
+	problems := []string{}
+	if !storeItemIdPattern.MatchString(item.Id) {
+		problems = append(problems, "id must be 1-64 letters, digits, '_', '.', ':' or '-'")
+	}
+	if item.Title == "" {
+		problems = append(problems, "title is required")
+	}
+	if item.Price < 0 {
+		problems = append(problems, "price cannot be negative")
+	}
+	if !containsString(subscriptionTiers, item.TierRequired) {
+		problems = append(problems, "tierRequired must be free, basic or premium")
+	}
+	if item.Stock != nil && *item.Stock < 0 {
+		problems = append(problems, "stock cannot be negative")
+	}
+	from, fromErr := time.Parse(time.RFC3339, item.AvailableFrom)
+	until, untilErr := time.Parse(time.RFC3339, item.AvailableUntil)
+	if item.AvailableFrom != "" && fromErr != nil {
+		problems = append(problems, "availableFrom must be an RFC 3339 timestamp")
+	}
+	if item.AvailableUntil != "" && untilErr != nil {
+		problems = append(problems, "availableUntil must be an RFC 3339 timestamp")
+	}
+	if fromErr == nil && untilErr == nil && !until.After(from) {
+		problems = append(problems, "availableUntil must be after availableFrom")
+	}
+	if len(problems) > 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid store item", "problems": problems})
+	}
+	if item.GameSlug != "" {
+		if _, err := findGameId(db, item.GameSlug); err != nil {
+			return FiberErrorResponse(c, err, "Database error")
+		}
+	}
+
+	var stock interface{}
+	if item.Stock != nil {
+		stock = *item.Stock
+	}
+	saved, err := scanStoreItem(db.QueryRow(`
+		INSERT INTO store_items(id, title, description, price, tierRequired, gameSlug, stock, availableFrom, availableUntil)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			title = excluded.title,
+			description = excluded.description,
+			price = excluded.price,
+			tierRequired = excluded.tierRequired,
+			gameSlug = excluded.gameSlug,
+			stock = excluded.stock,
+			availableFrom = excluded.availableFrom,
+			availableUntil = excluded.availableUntil,
+			retiredAt = NULL,
+			updatedAt = CURRENT_TIMESTAMP
+		RETURNING `+storeItemColumns,
+		item.Id, item.Title, item.Description, item.Price, item.TierRequired, item.GameSlug, stock, item.AvailableFrom, item.AvailableUntil))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Failed to save store item", err)
+	}
+	return c.JSON(saved)
+}
+
+/**
+ * RetireStoreItem takes an item off sale (admin only)
+ * Users who bought it keep it, and it still cannot be unlocked through a sync
+ * @param {*fiber.Ctx} c - Fiber context
+ * @param {*sql.DB} db - Database connection
+ * @returns {error} Error if any
+ */
+func RetireStoreItem(c *fiber.Ctx, db *sql.DB) error {
+	result, err := db.Exec(`
+		UPDATE store_items SET retiredAt = COALESCE(retiredAt, CURRENT_TIMESTAMP), updatedAt = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, c.Params("id"))
+	if err != nil {
+		return StandardErrorResponse(c, 500, "Database error", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrorResponse(c, 404, "Item not found")
+	}
+	return c.JSON(fiber.Map{"message": "Item retired"})
+}
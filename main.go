@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -30,6 +31,14 @@ func initializeAPIRoutes(app *fiber.App, db *sql.DB) {
 	apiGroup.Post("/logout", func(c *fiber.Ctx) error { return api.LogoutUser(c, db) })
 	apiGroup.Get("/games", func(c *fiber.Ctx) error { return api.GetGamesPublic(c, db) })
 	apiGroup.Get("/games/:slug/manifest", func(c *fiber.Ctx) error { return api.GetGameManifestPublic(c, db) })
+	apiGroup.Get("/games/:slug/package", func(c *fiber.Ctx) error { return api.GetGamePackage(c, db) })
+	apiGroup.Get("/games/:slug/achievements", func(c *fiber.Ctx) error { return api.GetGameAchievements(c, db) })
+	apiGroup.Get("/levels", func(c *fiber.Ctx) error { return api.GetLevels(c, db) })
+	apiGroup.Get("/store/items", func(c *fiber.Ctx) error { return api.GetStoreItems(c, db) })
+	apiGroup.Get("/categories", func(c *fiber.Ctx) error { return api.GetCategories(c, db) })
+	apiGroup.Get("/collections", func(c *fiber.Ctx) error { return api.GetCollections(c, db) })
+	apiGroup.Get("/collections/:slug", func(c *fiber.Ctx) error { return api.GetCollection(c, db) })
+	apiGroup.Post("/purchases/webhook", func(c *fiber.Ctx) error { return api.PurchaseWebhook(c, db) })
 
 	apiGroup.Use(api.AuthMiddleware)
 
@@ -38,8 +47,51 @@ func initializeAPIRoutes(app *fiber.App, db *sql.DB) {
 	apiGroup.Put("/users/:id", func(c *fiber.Ctx) error { return api.UpdateUser(c, db) })
 	apiGroup.Delete("/users/:id", func(c *fiber.Ctx) error { return api.DeleteUser(c, db) })
 
+	apiGroup.Get("/users/me/children", func(c *fiber.Ctx) error { return api.GetChildAccounts(c, db) })
+	apiGroup.Post("/users/me/children", func(c *fiber.Ctx) error { return api.CreateChildAccount(c, db) })
+	apiGroup.Put("/users/me/children/:id/controls", func(c *fiber.Ctx) error { return api.UpdateChildControls(c, db) })
+	apiGroup.Get("/play-time", func(c *fiber.Ctx) error { return api.GetMyPlayTime(c, db) })
+	apiGroup.Post("/play-sessions/heartbeat", func(c *fiber.Ctx) error { return api.PlaySessionHeartbeat(c, db) })
+	apiGroup.Get("/users/me/entitlements", func(c *fiber.Ctx) error { return api.GetMyEntitlements(c, db) })
+	apiGroup.Get("/users/me/favorites", func(c *fiber.Ctx) error { return api.GetMyFavorites(c, db) })
+	apiGroup.Put("/users/me/favorites/:slug", func(c *fiber.Ctx) error { return api.AddFavorite(c, db) })
+	apiGroup.Delete("/users/me/favorites/:slug", func(c *fiber.Ctx) error { return api.RemoveFavorite(c, db) })
+
 	apiGroup.Get("/progression", func(c *fiber.Ctx) error { return api.GetProgression(c, db) })
 	apiGroup.Post("/progression/sync", func(c *fiber.Ctx) error { return api.SyncProgression(c, db) })
+	apiGroup.Get("/games/:slug/progression", func(c *fiber.Ctx) error { return api.GetGameProgression(c, db) })
+	apiGroup.Get("/progression/history", func(c *fiber.Ctx) error { return api.GetProgressionHistory(c, db) })
+	apiGroup.Get("/games/:slug/saves", func(c *fiber.Ctx) error { return api.GetGameSaves(c, db) })
+	apiGroup.Get("/games/:slug/saves/:slot", func(c *fiber.Ctx) error { return api.GetGameSave(c, db) })
+	apiGroup.Get("/games/:slug/saves/:slot/revisions", func(c *fiber.Ctx) error { return api.GetGameSaveRevisions(c, db) })
+	apiGroup.Put("/games/:slug/saves/:slot", func(c *fiber.Ctx) error { return api.PutGameSave(c, db) })
+	apiGroup.Delete("/games/:slug/saves/:slot", func(c *fiber.Ctx) error { return api.DeleteGameSave(c, db) })
+	apiGroup.Post("/store/purchase", func(c *fiber.Ctx) error { return api.PurchaseStoreItem(c, db) })
+	apiGroup.Get("/store/purchases", func(c *fiber.Ctx) error { return api.GetPurchaseHistory(c, db) })
+
+	adminGroup := apiGroup.Group("/admin", func(c *fiber.Ctx) error { return api.AdminMiddleware(c, db) })
+
+	adminGroup.Get("/users/:id/entitlements", func(c *fiber.Ctx) error { return api.GetUserEntitlements(c, db) })
+	adminGroup.Post("/entitlements", func(c *fiber.Ctx) error { return api.GrantEntitlement(c, db) })
+	adminGroup.Delete("/entitlements/:id", func(c *fiber.Ctx) error { return api.RevokeEntitlement(c, db) })
+	adminGroup.Post("/games", api.RequireContentLength(api.MaxGameBundleBytes), func(c *fiber.Ctx) error { return api.UploadGame(c, db) })
+	adminGroup.Patch("/games/:slug", func(c *fiber.Ctx) error { return api.UpdateGameMetadata(c, db) })
+	adminGroup.Delete("/games/:slug", func(c *fiber.Ctx) error { return api.RetireGame(c, db) })
+	adminGroup.Get("/games/:slug/releases", func(c *fiber.Ctx) error { return api.GetGameReleases(c, db) })
+	adminGroup.Post("/games/:slug/releases/:version/publish", func(c *fiber.Ctx) error { return api.PublishGameRelease(c, db) })
+	adminGroup.Post("/games/:slug/rollback", func(c *fiber.Ctx) error { return api.RollbackGameRelease(c, db) })
+	adminGroup.Post("/categories", func(c *fiber.Ctx) error { return api.CreateCategory(c, db) })
+	adminGroup.Delete("/categories/:slug", func(c *fiber.Ctx) error { return api.DeleteCategory(c, db) })
+	adminGroup.Put("/games/:slug/taxonomy", func(c *fiber.Ctx) error { return api.SetGameTaxonomy(c, db) })
+	adminGroup.Post("/collections", func(c *fiber.Ctx) error { return api.SaveCollection(c, db) })
+	adminGroup.Put("/collections/:slug", func(c *fiber.Ctx) error { return api.SaveCollection(c, db) })
+	adminGroup.Delete("/collections/:slug", func(c *fiber.Ctx) error { return api.DeleteCollection(c, db) })
+	adminGroup.Get("/progression/anomalies", func(c *fiber.Ctx) error { return api.GetProgressionAnomalies(c, db) })
+	adminGroup.Post("/users/:id/progression/recompute", func(c *fiber.Ctx) error { return api.RecomputeProgression(c, db) })
+	adminGroup.Post("/progression/anomalies/:id/review", func(c *fiber.Ctx) error { return api.ReviewProgressionAnomaly(c, db) })
+	adminGroup.Put("/levels", func(c *fiber.Ctx) error { return api.UpdateLevels(c, db) })
+	adminGroup.Put("/store/items/:id", func(c *fiber.Ctx) error { return api.SaveStoreItem(c, db) })
+	adminGroup.Delete("/store/items/:id", func(c *fiber.Ctx) error { return api.RetireStoreItem(c, db) })
 }
 
 /**
@@ -66,19 +118,36 @@ func main() {
 		log.Println("Warning: No .env file found or error loading it. Using environment variables.")
 	}
 
-	// Initialize JWT authentication with secret from environment
-	api.InitializeAuth()
-
 	dbPath := flag.String("db", "app.db", "a path to a sqlite db")
 	port := flag.String("port", "8080", "a port to run on")
+	importGames := flag.Bool("import-games", false, "sync the games table with the packages in ./games and exit")
+	dryRun := flag.Bool("dry-run", false, "with -import-games, report drift without writing to the database")
 	flag.Parse()
 
 	db := api.InitializeDatabase(*dbPath)
 
-	app := fiber.New()
+	if *importGames {
+		os.Exit(runGameImport(db, *dryRun))
+	}
+
+	// Initialize JWT authentication with secret from environment
+	api.InitializeAuth()
+
+	// Logging goes to app.log, so also say on the console when search runs without FTS5
+	if !api.FullTextSearchEnabled {
+		fmt.Println("Game search is using LIKE matching; build with -tags sqlite_fts5 for full-text search and relevance sorting")
+	}
+
+	// Bodies are streamed so game uploads can be spooled to disk; api.BodyLimit and api.RequireContentLength enforce the limits instead
+	app := fiber.New(fiber.Config{StreamRequestBody: true, DisablePreParseMultipartForm: true})
+
+	// Only the game upload may send more than the default limit, checked on its route after the admin check
+	app.Use(api.BodyLimit(fiber.DefaultBodyLimit, func(c *fiber.Ctx) bool {
+		return c.Method() == fiber.MethodPost && strings.TrimSuffix(c.Path(), "/") == "/api/admin/games"
+	}))
 
 	app.Static("/public", "./public")
-	app.Static("/games", "./games")
+	app.Get("/games/*", func(c *fiber.Ctx) error { return api.ServeGameFile(c, db) })
 
 	initializeAPIRoutes(app, db)
 
@@ -118,6 +187,29 @@ func main() {
 	handleShutdown(app, db)
 }
 
+/**
+ * Syncs the games table with ./games and prints the report
+ * @param {*sql.DB} db - Database connection object, closed before returning
+ * @param {bool} dryRun - Report drift without writing to the database
+ * @returns {int} Process exit code, 1 if the import failed or any package was skipped
+ */
+func runGameImport(db *sql.DB, dryRun bool) int {
+	defer db.Close()
+
+	report, err := api.SyncGames(db, api.GamesDir, dryRun)
+	if err != nil {
+		log.Printf("Game import failed: %v", err)
+		fmt.Printf("Game import failed: %v\n", err)
+		return 1
+	}
+
+	api.PrintGameSyncReport(os.Stdout, report, dryRun)
+	if report.HasErrors() {
+		return 1
+	}
+	return 0
+}
+
 /**
  * Handles graceful shutdown of the application
  * @param {*fiber.App} app - Fiber application instance
@@ -1,7 +1,45 @@
 import { getGameCacheStatus, downloadGame, deleteGameCache, formatBytes } from '../modules/game-cache.js';
 import { navigate } from '../modules/router.js';
 
+function renderLockedGameCard(game) {
+  const card = document.createElement('div');
+  card.className = 'game-card game-card-locked';
+  card.dataset.gameSlug = game.slug;
+
+  const {reason, requiredTier, upgradeOptions = []} = game.access;
+  const action = reason === 'login_required'
+    ? '<button class="btn btn-primary" data-auth-action="show-auth" data-mode="login">Log In to Unlock</button>'
+    : `<button class="btn btn-primary" data-action="upgrade">Upgrade to ${upgradeOptions[0] || requiredTier}</button>`;
+
+  card.innerHTML = `
+    <div class="game-card-content">
+      <div class="game-thumbnail"><div class="game-icon">🔒</div></div>
+      <div class="game-info">
+        <h3 class="game-title">${game.name}</h3>
+        <p class="game-description">${game.description || 'No description available'}</p>
+        <div class="game-meta">
+          <span class="game-version">v${game.version}</span>
+          <span class="game-size">${formatBytes(game.sizeBytes)}</span>
+          <span class="game-tier tier-${requiredTier}">${requiredTier}</span>
+        </div>
+        <div class="game-status locked">Requires ${requiredTier}</div>
+      </div>
+      <div class="game-actions">${action}</div>
+    </div>
+  `;
+
+  card.querySelector('[data-action="upgrade"]')?.addEventListener('click', () => {
+    window.dispatchEvent(new CustomEvent('upgrade:requested', {detail: {gameSlug: game.slug, requiredTier, upgradeOptions}}));
+  });
+
+  return card;
+}
+
 export function renderGameCard(game) {
+  if (game.access && !game.access.granted) {
+    return renderLockedGameCard(game);
+  }
+
   const card = document.createElement('div');
   card.className = 'game-card';
   card.dataset.gameSlug = game.slug;
@@ -10,8 +48,11 @@ export function renderGameCard(game) {
   const isOnline = navigator.onLine;
 
   const canPlay = cacheStatus.cached || isOnline;
-  const statusText = cacheStatus.downloading ? 'Downloading...' : cacheStatus.cached ? '✓ Downloaded' : 'Not Downloaded';
+  const updateAvailable = cacheStatus.cached && cacheStatus.version && cacheStatus.version !== game.version;
+  const statusText = cacheStatus.downloading ? 'Downloading...' : updateAvailable ? 'Update available' : cacheStatus.cached ? '✓ Downloaded' : 'Not Downloaded';
   const statusClass = cacheStatus.downloading ? 'downloading' : cacheStatus.cached ? 'cached' : 'not-cached';
+  const cacheAction = updateAvailable ? 'download' : cacheStatus.cached ? 'delete' : 'download';
+  const cacheLabel = updateAvailable ? 'Update' : cacheStatus.cached ? 'Delete' : 'Download';
 
   card.innerHTML = `
     <div class="game-card-content">
@@ -28,7 +69,7 @@ export function renderGameCard(game) {
       </div>
       <div class="game-actions">
         <button class="btn btn-primary game-play-btn" ${!canPlay ? 'disabled' : ''} data-action="play" data-game-slug="${game.slug}">${canPlay ? 'Play' : 'Offline'}</button>
-        ${!cacheStatus.downloading ? `<button class="btn btn-secondary game-download-btn" data-action="${cacheStatus.cached ? 'delete' : 'download'}" data-game-slug="${game.slug}">${cacheStatus.cached ? 'Delete' : 'Download'}</button>` : '<button class="btn btn-secondary" disabled>Downloading...</button>'}
+        ${!cacheStatus.downloading ? `<button class="btn btn-secondary game-download-btn" data-action="${cacheAction}" data-game-slug="${game.slug}">${cacheLabel}</button>` : '<button class="btn btn-secondary" disabled>Downloading...</button>'}
       </div>
     </div>
   `;
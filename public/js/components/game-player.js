@@ -1,6 +1,9 @@
-import { updateProgression, getProgression, syncWithServer } from '../modules/progression.js';
+import { updateProgression, getProgression, syncWithServer, loadGameProgression } from '../modules/progression.js';
 import { navigate } from '../modules/router.js';
 import { isAuthenticated } from '../modules/api-client.js';
+import { startPlaySession, stopPlaySession, getCurrentSession } from '../modules/play-time.js';
+import { getGameCacheStatus } from '../modules/game-cache.js';
+import { loadSave, writeSave, deleteSave } from '../modules/cloud-saves.js';
 
 export async function renderGamePlayer(gameSlug) {
   const content = document.getElementById('content');
@@ -16,15 +19,31 @@ export async function renderGamePlayer(gameSlug) {
         </div>
         <button class="btn btn-secondary" id="fullscreenBtn">⛶ Fullscreen</button>
       </div>
+      <div class="game-player-notice" id="playerNotice" hidden></div>
       <div class="game-player-frame-container" id="frameContainer">
-        <iframe id="gameFrame" src="/games/${gameSlug}/index.html" allowfullscreen></iframe>
+        <iframe id="gameFrame" allowfullscreen></iframe>
       </div>
     </div>
   `;
 
+  const {url, manifest} = await resolveGameEntry(gameSlug);
+  document.getElementById('gameFrame').src = url;
+
+  const missingFeatures = (manifest?.requiredFeatures || []).filter(feature => featureChecks[feature] && !featureChecks[feature]());
+  if (missingFeatures.length > 0) {
+    const notice = document.getElementById('playerNotice');
+    notice.textContent = `This browser may not run this game: missing ${missingFeatures.join(', ')}`;
+    notice.hidden = false;
+  }
+
   if (authenticated) {
     const progression = await getProgression();
     updateProgressionDisplay(progression);
+
+    startPlaySession(gameSlug, (status) => {
+      document.getElementById('frameContainer').innerHTML = `<div class="empty-state"><p>${status.reason || 'Play time is over for today.'}</p></div>`;
+    });
+    window.addEventListener('hashchange', stopPlaySession, {once: true});
   }
 
   document.getElementById('backBtn').addEventListener('click', () => navigate('/games'));
@@ -38,6 +57,11 @@ export async function renderGamePlayer(gameSlug) {
     } else if (container.msRequestFullscreen) {
       container.msRequestFullscreen();
     }
+
+    // Orientation can only be locked in fullscreen, and not on every device
+    if (manifest?.orientation === 'landscape' || manifest?.orientation === 'portrait') {
+      screen.orientation?.lock?.(manifest.orientation).catch(() => {});
+    }
   });
 
   window.addEventListener('message', async (event) => {
@@ -52,7 +76,10 @@ export async function renderGamePlayer(gameSlug) {
           coinsEarned: data.coinsEarned || 0,
           xpEarned: data.xpEarned || 0,
           newAchievements: data.newAchievements || [],
-          newUnlockedItems: data.newUnlockedItems || []
+          newUnlockedItems: data.newUnlockedItems || [],
+          ...(data.state !== undefined && {state: data.state}),
+          gameSlug,
+          sessionId: getCurrentSession()?.sessionId || ''
         });
 
         updateProgressionDisplay(updated);
@@ -61,15 +88,42 @@ export async function renderGamePlayer(gameSlug) {
         iframe?.contentWindow?.postMessage({type: 'progression.confirmed', data: {totalCoins: updated.coins, totalXp: updated.xp}}, window.location.origin);
 
         if (navigator.onLine) {
-          syncWithServer().catch(err => console.warn('Failed to sync:', err));
+          // The server may accept less than the game reported, so show its totals once synced
+          syncWithServer()
+            .then(serverProgression => {
+              if (!serverProgression) return;
+              updateProgressionDisplay(serverProgression);
+              if (serverProgression.levelUps.length > 0 || serverProgression.unlockedAchievements.length > 0) {
+                iframe?.contentWindow?.postMessage({type: 'progression.celebrate', data: {level: serverProgression.level, levelUps: serverProgression.levelUps, unlockedAchievements: serverProgression.unlockedAchievements}}, window.location.origin);
+              }
+            })
+            .catch(err => console.warn('Failed to sync:', err));
         }
       } catch (error) {
         console.error('Failed to update progression:', error);
       }
     } else if (type === 'progression.request') {
       const current = await getProgression();
+      const game = await loadGameProgression(gameSlug);
+      const iframe = document.getElementById('gameFrame');
+      iframe?.contentWindow?.postMessage({type: 'progression.response', data: {coins: current.coins, xp: current.xp, level: current.level, xpToNextLevel: current.xpToNextLevel, achievements: current.achievements, unlockedItems: current.unlockedItems, game: {xp: game.xp, achievements: game.achievements, unlockedItems: game.unlockedItems, state: game.state}}}, window.location.origin);
+    } else if (type === 'save.load' || type === 'save.write' || type === 'save.delete') {
+      // Cloud saves answer with the same type plus '.result', or '.error'
       const iframe = document.getElementById('gameFrame');
-      iframe?.contentWindow?.postMessage({type: 'progression.response', data: {coins: current.coins, xp: current.xp, achievements: current.achievements, unlockedItems: current.unlockedItems}}, window.location.origin);
+      const slot = data?.slot || 'default';
+      try {
+        let result;
+        if (type === 'save.load') {
+          result = await loadSave(gameSlug, slot);
+        } else if (type === 'save.write') {
+          result = await writeSave(gameSlug, slot, data.data, {overwrite: data.overwrite === true});
+        } else {
+          result = await deleteSave(gameSlug, slot);
+        }
+        iframe?.contentWindow?.postMessage({type: `${type}.result`, data: {slot, ...result}}, window.location.origin);
+      } catch (error) {
+        iframe?.contentWindow?.postMessage({type: `${type}.error`, data: {slot, error: error.message}}, window.location.origin);
+      }
     }
   });
 
@@ -87,9 +141,33 @@ export async function renderGamePlayer(gameSlug) {
   }
 }
 
+const featureChecks = {
+  webgl: () => !!document.createElement('canvas').getContext('webgl'),
+  webgl2: () => !!document.createElement('canvas').getContext('webgl2'),
+  webaudio: () => 'AudioContext' in window || 'webkitAudioContext' in window,
+  wasm: () => typeof WebAssembly === 'object',
+  fullscreen: () => !!(document.fullscreenEnabled || document.webkitFullscreenEnabled),
+  pointerlock: () => 'pointerLockElement' in document
+};
+
+// Releases live under versioned paths, so ask the manifest API where the live one is
+async function resolveGameEntry(gameSlug) {
+  const cached = getGameCacheStatus(gameSlug);
+  try {
+    const response = await fetch(`/api/games/${gameSlug}/manifest`, {headers: {'Authorization': localStorage.getItem('token') || ''}});
+    if (response.ok) {
+      const manifest = await response.json();
+      return {url: (manifest.baseUrl || `/games/${gameSlug}/`) + manifest.entryPoint, manifest};
+    }
+  } catch (error) {
+    console.warn('Failed to load game manifest, using cached location:', error);
+  }
+  return {url: (cached.baseUrl || `/games/${gameSlug}/`) + (cached.entryPoint || 'index.html'), manifest: null};
+}
+
 function updateProgressionDisplay(progression) {
   const display = document.getElementById('playerProgression');
   if (display) {
-    display.innerHTML = `<span class="coins-display">💰 ${progression.coins}</span><span class="xp-display">⭐ ${progression.xp} XP</span>`;
+    display.innerHTML = `<span class="coins-display">💰 ${progression.coins}</span><span class="xp-display">⭐ ${progression.xp} XP</span>${progression.level ? `<span class="level-display">Level ${progression.level}</span>` : ''}`;
   }
 }
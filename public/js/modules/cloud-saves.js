@@ -0,0 +1,64 @@
+import { getDeviceId } from './progression.js';
+
+// The revision this device last read or wrote, per slot, so writes based on an older one are caught as conflicts
+const REVISION_KEY_PREFIX = 'saveRevision:';
+
+function saveUrl(gameSlug, slot) {
+  return `/api/games/${encodeURIComponent(gameSlug)}/saves/${encodeURIComponent(slot)}`;
+}
+
+function revisionKey(gameSlug, slot) {
+  return `${REVISION_KEY_PREFIX}${gameSlug}:${slot}`;
+}
+
+function decodeSaveData(base64) {
+  const bytes = Uint8Array.from(atob(base64 || ''), c => c.charCodeAt(0));
+  return new TextDecoder().decode(bytes);
+}
+
+async function loadSave(gameSlug, slot) {
+  const response = await fetch(saveUrl(gameSlug, slot), {headers: {'Authorization': localStorage.getItem('token') || ''}});
+  if (response.status === 404) {
+    localStorage.removeItem(revisionKey(gameSlug, slot));
+    return null;
+  }
+  if (!response.ok) throw new Error(`Failed to load save: ${response.status}`);
+
+  const revision = Number(response.headers.get('ETag')?.replaceAll('"', ''));
+  localStorage.setItem(revisionKey(gameSlug, slot), String(revision));
+  return {slot, revision, data: await response.text()};
+}
+
+// Returns the new revision, or the conflict with both versions when another device saved first
+async function writeSave(gameSlug, slot, data, {overwrite = false} = {}) {
+  const body = typeof data === 'string' ? data : JSON.stringify(data);
+  const revision = localStorage.getItem(revisionKey(gameSlug, slot));
+  const headers = {
+    'Authorization': localStorage.getItem('token') || '',
+    'Content-Type': typeof data === 'string' ? 'text/plain' : 'application/json',
+    'X-Device-Id': getDeviceId()
+  };
+  if (overwrite) {
+    headers['If-Match'] = '*';
+  } else if (revision) {
+    headers['If-Match'] = `"${revision}"`;
+  }
+
+  const response = await fetch(saveUrl(gameSlug, slot), {method: 'PUT', headers, body});
+  const result = await response.json();
+  if (response.status === 409 && result.current) {
+    return {conflict: {current: {revision: result.current.revision, data: decodeSaveData(result.current.data), deviceId: result.current.deviceId, updatedAt: result.current.updatedAt}, attempted: body}};
+  }
+  if (!response.ok) throw new Error(result.error || `Failed to save: ${response.status}`);
+
+  localStorage.setItem(revisionKey(gameSlug, slot), String(result.revision));
+  return {revision: result.revision};
+}
+
+async function deleteSave(gameSlug, slot) {
+  const response = await fetch(saveUrl(gameSlug, slot), {method: 'DELETE', headers: {'Authorization': localStorage.getItem('token') || ''}});
+  if (!response.ok && response.status !== 404) throw new Error(`Failed to delete save: ${response.status}`);
+  localStorage.removeItem(revisionKey(gameSlug, slot));
+}
+
+export {loadSave, writeSave, deleteSave};
@@ -16,26 +16,45 @@ function getGameCacheStatus(gameSlug) {
   return allStatus[gameSlug] || {cached: false, downloading: false};
 }
 
+async function fetchGameDelta(gameSlug, fromVersion, headers) {
+  try {
+    const response = await fetch(`/api/games/${gameSlug}/manifest?schema=2&from=${encodeURIComponent(fromVersion)}`, {headers});
+    return response.ok ? await response.json() : null;
+  } catch (error) {
+    return null;
+  }
+}
+
 async function downloadGame(gameSlug) {
+  const previous = getGameCacheStatus(gameSlug);
   setCacheStatus(gameSlug, {downloading: true, cached: false, progress: 0});
 
   try {
-    const response = await fetch(`/api/games/${gameSlug}/manifest`, {headers: {'Authorization': localStorage.getItem('token') || ''}});
+    const headers = {'Authorization': localStorage.getItem('token') || ''};
 
-    if (!response.ok) {
-      throw new Error('Failed to fetch manifest');
-    }
+    // An installed copy only needs the files that changed since its version
+    const delta = previous.cached && previous.version ? await fetchGameDelta(gameSlug, previous.version, headers) : null;
+
+    let manifest = delta;
+    if (!delta) {
+      const response = await fetch(`/api/games/${gameSlug}/manifest?schema=2`, {headers});
 
-    const manifest = await response.json();
+      if (!response.ok) {
+        throw new Error('Failed to fetch manifest');
+      }
+
+      manifest = await response.json();
+    }
 
     if ('serviceWorker' in navigator && navigator.serviceWorker.controller) {
-      navigator.serviceWorker.controller.postMessage({type: 'CACHE_GAME', gameSlug, manifest});
+      const token = localStorage.getItem('token') || '';
+      navigator.serviceWorker.controller.postMessage(delta ? {type: 'APPLY_GAME_DELTA', gameSlug, delta, token} : {type: 'CACHE_GAME_PACKAGE', gameSlug, manifest, token});
 
       return new Promise((resolve, reject) => {
         const messageHandler = (event) => {
           if (event.data.type === 'CACHE_COMPLETE' && event.data.gameSlug === gameSlug) {
             navigator.serviceWorker.removeEventListener('message', messageHandler);
-            setCacheStatus(gameSlug, {downloading: false, cached: true, progress: 100});
+            setCacheStatus(gameSlug, {downloading: false, cached: true, progress: 100, version: manifest.version, baseUrl: manifest.baseUrl, entryPoint: manifest.entryPoint});
             resolve();
           } else if (event.data.type === 'CACHE_ERROR' && event.data.gameSlug === gameSlug) {
             navigator.serviceWorker.removeEventListener('message', messageHandler);
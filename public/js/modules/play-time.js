@@ -0,0 +1,87 @@
+const PENDING_SESSIONS_KEY = 'pendingPlaySessions';
+
+let currentSession = null;
+let heartbeatTimer = null;
+
+function getPendingSessions() {
+  const pending = localStorage.getItem(PENDING_SESSIONS_KEY);
+  return pending ? JSON.parse(pending) : {};
+}
+
+function savePendingSession(session) {
+  const pending = getPendingSessions();
+  pending[session.sessionId] = session;
+  localStorage.setItem(PENDING_SESSIONS_KEY, JSON.stringify(pending));
+}
+
+function clearPendingSessions(sessionIds) {
+  const pending = getPendingSessions();
+  sessionIds.forEach(id => delete pending[id]);
+  localStorage.setItem(PENDING_SESSIONS_KEY, JSON.stringify(pending));
+}
+
+function snapshotCurrentSession() {
+  if (!currentSession) return null;
+  const seconds = Math.floor((Date.now() - currentSession.startedAtMs) / 1000);
+  return {sessionId: currentSession.sessionId, gameSlug: currentSession.gameSlug, startedAt: currentSession.startedAt, seconds};
+}
+
+async function sendHeartbeat() {
+  const snapshot = snapshotCurrentSession();
+  if (snapshot) savePendingSession(snapshot);
+
+  // Offline sessions go first; the server treats the last entry as the one still running
+  const pending = getPendingSessions();
+  const sessions = Object.values(pending).filter(s => !snapshot || s.sessionId !== snapshot.sessionId);
+  if (snapshot) sessions.push(snapshot);
+  if (sessions.length === 0 || !navigator.onLine) return null;
+
+  try {
+    const response = await fetch('/api/play-sessions/heartbeat', {method: 'POST', headers: {'Content-Type': 'application/json', 'Authorization': localStorage.getItem('token') || ''}, body: JSON.stringify({sessions})});
+    if (!response.ok) return null;
+
+    clearPendingSessions(sessions.filter(s => !snapshot || s.sessionId !== snapshot.sessionId).map(s => s.sessionId));
+    return await response.json();
+  } catch (error) {
+    console.warn('Play-time heartbeat failed, will retry later:', error);
+    return null;
+  }
+}
+
+function startPlaySession(gameSlug, onStop, intervalMs = 60000) {
+  stopPlaySession();
+
+  const now = new Date();
+  currentSession = {sessionId: crypto.randomUUID(), gameSlug, startedAt: now.toISOString(), startedAtMs: now.getTime()};
+
+  const beat = async () => {
+    const status = await sendHeartbeat();
+    if (status && !status.allowed) {
+      stopPlaySession();
+      onStop(status);
+    }
+  };
+
+  beat();
+  heartbeatTimer = setInterval(beat, intervalMs);
+}
+
+function stopPlaySession() {
+  if (heartbeatTimer) {
+    clearInterval(heartbeatTimer);
+    heartbeatTimer = null;
+  }
+
+  const snapshot = snapshotCurrentSession();
+  currentSession = null;
+  if (snapshot) {
+    savePendingSession(snapshot);
+    sendHeartbeat();
+  }
+}
+
+function getCurrentSession() {
+  return currentSession ? {sessionId: currentSession.sessionId, gameSlug: currentSession.gameSlug} : null;
+}
+
+export {startPlaySession, stopPlaySession, sendHeartbeat, getCurrentSession};
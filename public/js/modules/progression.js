@@ -1,9 +1,31 @@
+import { sendHeartbeat } from './play-time.js';
+
 const DB_NAME = 'CelestialArcadeDB';
 const DB_VERSION = 1;
 const PROGRESSION_STORE = 'progression';
 const PENDING_SYNC_STORE = 'pendingSync';
 
+const DEVICE_ID_KEY = 'deviceId';
+const SYNC_SEQUENCE_KEY = 'syncSequence';
+
 let db = null;
+let syncInFlight = null;
+
+function getDeviceId() {
+  let deviceId = localStorage.getItem(DEVICE_ID_KEY);
+  if (!deviceId) {
+    deviceId = crypto.randomUUID();
+    localStorage.setItem(DEVICE_ID_KEY, deviceId);
+  }
+  return deviceId;
+}
+
+// Every batch this device sends gets a higher sequence number, so the server can tell late batches apart
+function nextSyncSequence(atLeast = 0) {
+  const sequence = Math.max(Number(localStorage.getItem(SYNC_SEQUENCE_KEY)) || 0, atLeast) + 1;
+  localStorage.setItem(SYNC_SEQUENCE_KEY, String(sequence));
+  return sequence;
+}
 
 async function initProgressionDB() {
   return new Promise((resolve, reject) => {
@@ -56,6 +78,33 @@ async function saveProgression(progression) {
   });
 }
 
+async function getCachedGameProgression(gameSlug) {
+  if (!db) await initProgressionDB();
+
+  return new Promise((resolve, reject) => {
+    const transaction = db.transaction([PROGRESSION_STORE], 'readonly');
+    const store = transaction.objectStore(PROGRESSION_STORE);
+    const request = store.get(`game:${gameSlug}`);
+
+    request.onsuccess = () => resolve(request.result || {gameSlug, xp: 0, achievements: [], unlockedItems: [], state: {}});
+    request.onerror = () => reject(request.error);
+  });
+}
+
+async function saveGameProgression(gameProgression) {
+  if (!db) await initProgressionDB();
+
+  return new Promise((resolve, reject) => {
+    const transaction = db.transaction([PROGRESSION_STORE], 'readwrite');
+    const store = transaction.objectStore(PROGRESSION_STORE);
+    // Shares the progression store, keyed apart from the global 'current' record
+    const request = store.put({...gameProgression, userId: `game:${gameProgression.gameSlug}`});
+
+    request.onsuccess = () => resolve(request.result);
+    request.onerror = () => reject(request.error);
+  });
+}
+
 async function addPendingSync(syncData) {
   if (!db) await initProgressionDB();
 
@@ -82,6 +131,23 @@ async function getPendingSyncs() {
   });
 }
 
+async function assignBatchId(items, batchId, sequence) {
+  if (!db) await initProgressionDB();
+
+  return new Promise((resolve, reject) => {
+    const transaction = db.transaction([PENDING_SYNC_STORE], 'readwrite');
+    const store = transaction.objectStore(PENDING_SYNC_STORE);
+    items.forEach(item => {
+      item.batchId = batchId;
+      item.sequence = sequence;
+      store.put(item);
+    });
+
+    transaction.oncomplete = () => resolve();
+    transaction.onerror = () => reject(transaction.error);
+  });
+}
+
 async function clearPendingSync(id) {
   if (!db) await initProgressionDB();
 
@@ -113,34 +179,85 @@ async function updateProgression(update) {
   return updated;
 }
 
-async function syncWithServer() {
+function syncWithServer() {
+  // Overlapping syncs would put the same pending items into two batches
+  if (!syncInFlight) {
+    syncInFlight = sendPendingSyncs().finally(() => {
+      syncInFlight = null;
+    });
+  }
+  return syncInFlight;
+}
+
+async function sendPendingSyncs() {
   const pending = await getPendingSyncs();
   if (pending.length === 0) return;
 
-  const aggregated = pending.reduce((acc, item) => ({
-    coinsEarned: acc.coinsEarned + (item.coinsEarned || 0),
-    xpEarned: acc.xpEarned + (item.xpEarned || 0),
-    newAchievements: [...new Set([...acc.newAchievements, ...(item.newAchievements || [])])],
-    newUnlockedItems: [...new Set([...acc.newUnlockedItems, ...(item.newUnlockedItems || [])])],
-    clientLastSyncedAt: new Date().toISOString()
-  }), {coinsEarned: 0, xpEarned: 0, newAchievements: [], newUnlockedItems: []});
+  // Earning limits are per game and per play session, so each is synced separately.
+  // Items sent before keep their batch id, so a retry is recognised by the server.
+  const groups = new Map();
+  for (const item of pending) {
+    const key = item.batchId ? `batch:${item.batchId}` : `${item.gameSlug || ''}|${item.sessionId || ''}`;
+    if (!groups.has(key)) groups.set(key, []);
+    groups.get(key).push(item);
+  }
 
-  try {
-    const response = await fetch('/api/progression/sync', {method: 'POST', headers: {'Content-Type': 'application/json', 'Authorization': localStorage.getItem('token') || ''}, body: JSON.stringify(aggregated)});
+  let serverProgression;
+  const levelUps = [];
+  const unlockedAchievements = [];
+  const changes = [];
+  for (const items of groups.values()) {
+    if (!items[0].batchId) {
+      await assignBatchId(items, crypto.randomUUID(), nextSyncSequence());
+    }
 
-    if (response.ok) {
-      const serverProgression = await response.json();
-      await saveProgression(serverProgression);
+    const aggregated = items.reduce((acc, item) => ({
+      ...acc,
+      coinsEarned: acc.coinsEarned + (item.coinsEarned || 0),
+      xpEarned: acc.xpEarned + (item.xpEarned || 0),
+      newAchievements: [...new Set([...acc.newAchievements, ...(item.newAchievements || [])])],
+      newUnlockedItems: [...new Set([...acc.newUnlockedItems, ...(item.newUnlockedItems || [])])],
+      // The newest state replaces older ones
+      ...(item.state !== undefined && {state: item.state})
+    }), {coinsEarned: 0, xpEarned: 0, newAchievements: [], newUnlockedItems: [], gameSlug: items[0].gameSlug || '', sessionId: items[0].sessionId || '', batchId: items[0].batchId, sequence: items[0].sequence || 0, deviceId: getDeviceId(), clientLastSyncedAt: new Date().toISOString()});
+
+    try {
+      const response = await fetch('/api/progression/sync', {method: 'POST', headers: {'Content-Type': 'application/json', 'Authorization': localStorage.getItem('token') || ''}, body: JSON.stringify(aggregated)});
+      if (response.status === 409) {
+        // The sequence number was already used (e.g. local storage was restored), so send the batch again as a new one
+        const {lastSequence} = await response.json();
+        await assignBatchId(items, crypto.randomUUID(), nextSyncSequence(lastSequence));
+        continue;
+      }
+      if (!response.ok) continue;
 
-      for (const item of pending) {
-        await clearPendingSync(item.id);
+      const {accepted, replayed, game, levelUps: reachedLevels, unlockedAchievements: unlocked, outOfOrder, changes: serverChanges, changesTruncated, ...progression} = await response.json();
+      if (outOfOrder) {
+        console.warn('Server applied a late progression batch without its state');
+      }
+      if (accepted?.adjustments?.length > 0) {
+        console.warn('Server adjusted progression sync:', accepted.adjustments);
+      }
+      // A replayed batch carries the totals from when it was first applied, which may be stale
+      if (!replayed) {
+        serverProgression = progression;
+        await saveProgression(serverProgression);
+        if (game) await saveGameProgression(game);
+        levelUps.push(...(reachedLevels || []));
+        unlockedAchievements.push(...(unlocked || []));
+        changes.push(...(serverChanges || []));
       }
 
-      return serverProgression;
+      for (const item of items) {
+        await clearPendingSync(item.id);
+      }
+    } catch (error) {
+      console.warn('Sync failed, will retry later:', error);
     }
-  } catch (error) {
-    console.warn('Sync failed, will retry later:', error);
   }
+
+  // Level-ups, achievements and other devices' changes are only reported once, so pass them on to callers
+  return serverProgression && {...serverProgression, levelUps, unlockedAchievements, changes};
 }
 
 async function loadServerProgression() {
@@ -159,6 +276,22 @@ async function loadServerProgression() {
   return await getProgression();
 }
 
+async function loadGameProgression(gameSlug) {
+  try {
+    const response = await fetch(`/api/games/${encodeURIComponent(gameSlug)}/progression`, {headers: {'Authorization': localStorage.getItem('token') || ''}});
+
+    if (response.ok) {
+      const gameProgression = await response.json();
+      await saveGameProgression(gameProgression);
+      return gameProgression;
+    }
+  } catch (error) {
+    console.warn('Failed to load game progression:', error);
+  }
+
+  return await getCachedGameProgression(gameSlug);
+}
+
 function startAutoSync(intervalMs = 60000) {
   setInterval(() => {
     if (navigator.onLine) {
@@ -166,9 +299,11 @@ function startAutoSync(intervalMs = 60000) {
     }
   }, intervalMs);
 
-  window.addEventListener('online', () => {
+  window.addEventListener('online', async () => {
+    // Report play time first, since earning limits are measured against it
+    await sendHeartbeat();
     syncWithServer().catch(err => console.warn('Online sync failed:', err));
   });
 }
 
-export {initProgressionDB, getProgression, saveProgression, updateProgression, syncWithServer, loadServerProgression, startAutoSync};
+export {getDeviceId, initProgressionDB, getProgression, saveProgression, updateProgression, syncWithServer, loadServerProgression, loadGameProgression, startAutoSync};
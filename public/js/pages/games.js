@@ -30,7 +30,7 @@ export async function render() {
 
   try {
     const authHeader = localStorage.getItem('token') ? `Bearer ${localStorage.getItem('token')}` : '';
-    const gamesResponse = await fetch('/api/games', {headers: {'Authorization': authHeader}});
+    const gamesResponse = await fetch('/api/games?includeLocked=true', {headers: {'Authorization': authHeader}});
 
     if (!gamesResponse.ok) {
       throw new Error('Failed to load games');
@@ -42,14 +42,14 @@ export async function render() {
     if (authenticated) {
       const [progression, cacheSize] = await Promise.all([getProgression(), getCacheSize()]);
       document.getElementById('tierBadge').innerHTML = `<span class="tier-badge-${userTier}">${userTier.toUpperCase()}</span>`;
-      document.getElementById('progressionDisplay').innerHTML = `<span class="coins-display">💰 ${progression.coins}</span><span class="xp-display">⭐ ${progression.xp} XP</span>`;
+      document.getElementById('progressionDisplay').innerHTML = `<span class="coins-display">💰 ${progression.coins}</span><span class="xp-display">⭐ ${progression.xp} XP</span>${progression.level ? `<span class="level-display">Level ${progression.level}${progression.xpToNextLevel ? `, ${progression.xpToNextLevel} XP to next` : ''}</span>` : ''}`;
       document.getElementById('storageInfo').innerHTML = `<span class="storage-display">💾 ${formatBytes(cacheSize.usage)} / ${formatBytes(cacheSize.quota)} (${cacheSize.usagePercent}%)</span>`;
     }
 
     const gamesGrid = document.getElementById('gamesGrid');
 
     if (games.length === 0) {
-      gamesGrid.innerHTML = '<div class="empty-state"><p>No games available for your subscription tier.</p></div>';
+      gamesGrid.innerHTML = '<div class="empty-state"><p>No games available yet.</p></div>';
       return;
     }
 
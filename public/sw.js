@@ -1,4 +1,4 @@
-const CACHE_VERSION = 'v1';
+const CACHE_VERSION = 'v2';
 const STATIC_CACHE = `static-${CACHE_VERSION}`;
 const GAME_CACHE_PREFIX = 'game-';
 
@@ -92,7 +92,11 @@ async function handleStaticRequest(request) {
 
 self.addEventListener('message', (event) => {
   if (event.data.type === 'CACHE_GAME') {
-    event.waitUntil(cacheGame(event.data.gameSlug, event.data.manifest));
+    event.waitUntil(cacheGame(event.data.gameSlug, event.data.manifest, event.data.token));
+  } else if (event.data.type === 'CACHE_GAME_PACKAGE') {
+    event.waitUntil(cacheGamePackage(event.data.gameSlug, event.data.manifest, event.data.token));
+  } else if (event.data.type === 'APPLY_GAME_DELTA') {
+    event.waitUntil(applyGameDelta(event.data.gameSlug, event.data.delta, event.data.token));
   } else if (event.data.type === 'DELETE_GAME_CACHE') {
     event.waitUntil(deleteGameCache(event.data.gameSlug));
   } else if (event.data.type === 'GET_CACHE_SIZE') {
@@ -100,43 +104,167 @@ self.addEventListener('message', (event) => {
   }
 });
 
-async function cacheGame(gameSlug, manifest) {
+async function cacheGame(gameSlug, manifest, token) {
   const gameCacheName = `${GAME_CACHE_PREFIX}${gameSlug}`;
   const cache = await caches.open(gameCacheName);
 
-  const baseUrl = `/games/${gameSlug}/`;
-  const urlsToCache = [baseUrl + manifest.entryPoint, ...manifest.assets.map(asset => baseUrl + asset)];
+  const baseUrl = manifest.baseUrl || `/games/${gameSlug}/`;
 
-  const results = await Promise.allSettled(
-    urlsToCache.map(url => fetch(url).then(response => {
-      if (response.ok) {
-        return cache.put(url, response);
+  // Schema 2 manifests list assets as objects with an SRI hash; schema 1 lists bare paths
+  const assets = manifest.assets.map(asset => typeof asset === 'string' ? {path: asset} : asset);
+  if (!assets.some(asset => asset.path === manifest.entryPoint)) {
+    assets.unshift({path: manifest.entryPoint});
+  }
+
+  // Drop files from earlier releases, which live under a different versioned path
+  await pruneGameCache(cache, assets.map(asset => baseUrl + asset.path));
+
+  const failures = await fetchIntoCache(cache, baseUrl, assets, manifest.assetQuery, token);
+  notifyClients(failures > 0 ? {type: 'CACHE_ERROR', gameSlug, failures} : {type: 'CACHE_COMPLETE', gameSlug});
+}
+
+async function cacheGamePackage(gameSlug, manifest, token) {
+  const gameCacheName = `${GAME_CACHE_PREFIX}${gameSlug}`;
+  const cache = await caches.open(gameCacheName);
+
+  let index;
+  try {
+    const headers = token ? {'Authorization': token} : {};
+    const blob = await fetchResumable(`/api/games/${gameSlug}/package`, headers);
+
+    const indexLength = new DataView(await blob.slice(0, 4).arrayBuffer()).getUint32(0);
+    index = JSON.parse(await blob.slice(4, 4 + indexLength).text());
+    const dataStart = 4 + indexLength;
+
+    await Promise.all(index.assets.map(async (asset) => {
+      const body = blob.slice(dataStart + asset.offset, dataStart + asset.offset + asset.size);
+      const digest = await crypto.subtle.digest('SHA-256', await body.arrayBuffer());
+      const sha256 = Array.from(new Uint8Array(digest), b => b.toString(16).padStart(2, '0')).join('');
+      if (sha256 !== asset.sha256) {
+        throw new Error(`Checksum mismatch for ${asset.path}`);
       }
-      throw new Error(`Failed to fetch ${url}`);
-    }))
-  );
+      await cache.put(index.baseUrl + asset.path, new Response(body, {headers: {'Content-Type': asset.mimeType}}));
+    }));
+  } catch (error) {
+    // Fall back to fetching the files one by one
+    return cacheGame(gameSlug, manifest, token);
+  }
 
-  const failures = results.filter(r => r.status === 'rejected');
-  if (failures.length > 0) {
-    self.clients.matchAll().then(clients => {
-      clients.forEach(client => client.postMessage({type: 'CACHE_ERROR', gameSlug, failures: failures.length}));
-    });
-  } else {
-    self.clients.matchAll().then(clients => {
-      clients.forEach(client => client.postMessage({type: 'CACHE_COMPLETE', gameSlug}));
-    });
+  await pruneGameCache(cache, index.assets.map(asset => index.baseUrl + asset.path));
+  notifyClients({type: 'CACHE_COMPLETE', gameSlug});
+}
+
+// Downloads a whole response, picking up where it stopped after a dropped connection.
+// If-Range makes the server start over if the package changed in between
+async function fetchResumable(url, headers, attempts = 3) {
+  const chunks = [];
+  let received = 0;
+  let etag = null;
+
+  for (let attempt = 1; attempt <= attempts; attempt++) {
+    const requestHeaders = {...headers};
+    if (received > 0 && etag) {
+      requestHeaders['Range'] = `bytes=${received}-`;
+      requestHeaders['If-Range'] = etag;
+    }
+
+    let response;
+    try {
+      response = await fetch(url, {headers: requestHeaders, cache: 'no-store'});
+    } catch (error) {
+      if (attempt === attempts) throw error;
+      continue;
+    }
+    if (response.status !== 200 && response.status !== 206) {
+      throw new Error(`Failed to fetch ${url}: ${response.status}`);
+    }
+    if (response.status === 200) {
+      chunks.length = 0;
+      received = 0;
+    }
+    etag = response.headers.get('ETag');
+
+    try {
+      const reader = response.body.getReader();
+      for (;;) {
+        const {done, value} = await reader.read();
+        if (done) break;
+        chunks.push(value);
+        received += value.length;
+      }
+      return new Blob(chunks);
+    } catch (error) {
+      if (attempt === attempts) throw error;
+    }
   }
 }
 
-async function deleteGameCache(gameSlug) {
+async function applyGameDelta(gameSlug, delta, token) {
   const gameCacheName = `${GAME_CACHE_PREFIX}${gameSlug}`;
-  await caches.delete(gameCacheName);
+  const cache = await caches.open(gameCacheName);
+
+  // Unchanged files are re-keyed under the new release's path instead of downloaded again
+  const toFetch = [...delta.added, ...delta.changed];
+  await Promise.all(delta.unchanged.map(async (assetPath) => {
+    const cachedResponse = await cache.match(delta.previousBaseUrl + assetPath);
+    if (cachedResponse) {
+      await cache.put(delta.baseUrl + assetPath, cachedResponse);
+    } else {
+      toFetch.push({path: assetPath});
+    }
+  }));
 
+  const paths = [...delta.unchanged, ...delta.added.map(asset => asset.path), ...delta.changed.map(asset => asset.path)];
+  if (!paths.includes(delta.entryPoint)) {
+    paths.push(delta.entryPoint);
+    toFetch.push({path: delta.entryPoint});
+  }
+
+  const failures = await fetchIntoCache(cache, delta.baseUrl, toFetch, delta.assetQuery, token);
+  if (failures === 0) {
+    await pruneGameCache(cache, paths.map(assetPath => delta.baseUrl + assetPath));
+  }
+  notifyClients(failures > 0 ? {type: 'CACHE_ERROR', gameSlug, failures} : {type: 'CACHE_COMPLETE', gameSlug});
+}
+
+async function fetchIntoCache(cache, baseUrl, assets, assetQuery, token) {
+  // Files of paid games are only served to entitled users: their manifests carry a signed
+  // query, with the token as a fallback. Entries are cached without the query so the
+  // player's own requests match them
+  const headers = token ? {'Authorization': token} : {};
+  const results = await Promise.allSettled(
+    assets.map(asset => {
+      const url = baseUrl + asset.path;
+      return fetch(url + (assetQuery || ''), asset.integrity ? {headers, integrity: asset.integrity} : {headers}).then(response => {
+        if (response.ok) {
+          return cache.put(url, response);
+        }
+        throw new Error(`Failed to fetch ${url}`);
+      });
+    })
+  );
+  return results.filter(r => r.status === 'rejected').length;
+}
+
+async function pruneGameCache(cache, urls) {
+  const wanted = new Set(urls.map(url => new URL(url, self.location.origin).href));
+  const cachedRequests = await cache.keys();
+  await Promise.all(cachedRequests.filter(request => !wanted.has(request.url)).map(request => cache.delete(request)));
+}
+
+function notifyClients(message) {
   self.clients.matchAll().then(clients => {
-    clients.forEach(client => client.postMessage({type: 'CACHE_DELETED', gameSlug}));
+    clients.forEach(client => client.postMessage(message));
   });
 }
 
+async function deleteGameCache(gameSlug) {
+  const gameCacheName = `${GAME_CACHE_PREFIX}${gameSlug}`;
+  await caches.delete(gameCacheName);
+
+  notifyClients({type: 'CACHE_DELETED', gameSlug});
+}
+
 async function getCacheSize() {
   if ('storage' in navigator && 'estimate' in navigator.storage) {
     const estimate = await navigator.storage.estimate();